@@ -1,6 +1,6 @@
 module godisdb
 
-go 1.21.0
+go 1.23
 
 require (
 	github.com/chzyer/readline v1.5.1
@@ -1,7 +1,10 @@
 package godis
 
 import (
+	"container/heap"
+	"encoding/binary"
 	"log"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -51,6 +54,8 @@ const (
 
 type FileProc func(loop *AeEventLoop, fd int, mask FileEventType, extra interface{})
 type TimeProc func(loop *AeEventLoop, fd int, extra interface{}) int
+type BeforeSleepProc func(loop *AeEventLoop)
+type AfterSleepProc func(loop *AeEventLoop)
 
 type AeFileEvent struct {
 	fd         int
@@ -65,55 +70,229 @@ type AeTimeEvent struct {
 	when  int //ms
 	mask  TimeEventType
 	proc  TimeProc
-	next  *AeTimeEvent
+	index int // position in the timer heap, -1 while it is being fired
 	extra interface{}
 }
 
-type EpollState struct {
-	epfd            int
-	events          []unix.EpollEvent
-	readyEventCount int
-	regfd           map[int]FileEventType
+// timerHeap is a binary min-heap of the time events ordered by when, ties
+// broken by creation order, so the nearest timer is always at the root and
+// creating or deleting one takes O(log n).
+type timerHeap []*AeTimeEvent
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when != h[j].when {
+		return h[i].when < h[j].when
+	}
+	return h[i].id < h[j].id
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	te := x.(*AeTimeEvent)
+	te.index = len(*h)
+	*h = append(*h, te)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	te := old[len(old)-1]
+	old[len(old)-1] = nil
+	te.index = -1
+	*h = old[:len(old)-1]
+	return te
+}
+
+const (
+	AE_POLLER_EPOLL string = "epoll"
+	AE_POLLER_POLL  string = "poll"
+)
+
+// Poller is the I/O multiplexing backend of an event loop. The loop keeps
+// track of the events registered for each descriptor, add is called with
+// the first ones, modify with every change after that and delete once none
+// is left. wait blocks for at most timeout milliseconds, -1 for no limit,
+// and returns the descriptors that are ready, valid until the next call.
+type Poller interface {
+	add(fd int, mask FileEventType) error
+	modify(fd int, mask FileEventType) error
+	delete(fd int) error
+	wait(timeout int) ([]AeFiredEvent, error)
+	close() error
+	name() string
+}
+
+// AeFiredEvent is a descriptor the poller found ready.
+type AeFiredEvent struct {
+	fd   int
+	mask FileEventType
 }
 
 type AeEventLoop struct {
 	fileEvents map[int]*AeFileEvent
 
 	timeEventNextId int
-	timeEventHead   *AeTimeEvent
+	timeEvents      map[int]*AeTimeEvent // by id
+	timers          timerHeap
 	lastTime        int
 	stop            bool
-	epoll           *EpollState
+	poller          Poller
+	fired           []AeFiredEvent
+	beforesleep     []BeforeSleepProc
+	aftersleep      []AfterSleepProc
+
+	post_mu  sync.Mutex
+	posted   []func() // posted by other goroutines, run by the loop
+	post_efd int      // eventfd waking the loop up when a function is posted
+	closed   bool
 }
 
+// AeCreateEventLoop creates an event loop polling with epoll.
 func AeCreateEventLoop() (*AeEventLoop, error) {
-	epoll_fd, err := unix.EpollCreate1(0)
-	if err != nil {
-		return nil, err
-	}
-	epoll_state := &EpollState{
-		epfd:            epoll_fd,
-		events:          make([]unix.EpollEvent, 1024),
-		readyEventCount: 0,
-		regfd:           make(map[int]FileEventType),
+	return AeCreateEventLoopWithPoller(AE_POLLER_EPOLL)
+}
+
+// AeCreateEventLoopWithPoller creates an event loop polling with the named
+// backend, AE_POLLER_EPOLL or AE_POLLER_POLL.
+func AeCreateEventLoopWithPoller(name string) (*AeEventLoop, error) {
+	var poller Poller
+	switch name {
+	case AE_POLLER_EPOLL:
+		epoll, err := newEpollPoller()
+		if err != nil {
+			return nil, err
+		}
+		poller = epoll
+	case AE_POLLER_POLL:
+		poller = newPollPoller()
+	default:
+		return nil, AeErr{msg: "unknown poller " + name}
 	}
 
 	loop := AeEventLoop{
 		fileEvents:      make(map[int]*AeFileEvent),
 		timeEventNextId: 1,
-		timeEventHead:   nil,
+		timeEvents:      make(map[int]*AeTimeEvent),
 		lastTime:        GetMsTime(),
 		stop:            false,
-		epoll:           epoll_state,
+		poller:          poller,
 	}
 
-	return &loop, err
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		poller.close()
+		return nil, err
+	}
+	loop.post_efd = efd
+	if err := loop.AeCreateFileEvent(efd, AE_READABLE, aeRunPosted, nil); err != nil {
+		unix.Close(efd)
+		poller.close()
+		return nil, err
+	}
+
+	return &loop, nil
+}
+
+// AeDeleteEventLoop releases the resources of the poller, the loop must be
+// stopped. Functions posted from then on are dropped.
+func (loop *AeEventLoop) AeDeleteEventLoop() error {
+	loop.post_mu.Lock()
+	if loop.closed {
+		loop.post_mu.Unlock()
+		return nil
+	}
+	loop.closed = true
+	loop.posted = nil
+	loop.post_mu.Unlock()
+	loop.AeDeleteFileEvent(loop.post_efd, AE_READABLE, nil)
+	unix.Close(loop.post_efd)
+	return loop.poller.close()
+}
+
+// AePost queues task to run on the loop goroutine, between events, and
+// wakes the loop up if it is waiting. It is the only method of the loop
+// that may be called from any goroutine, the tasks run in the order they
+// were posted.
+func (loop *AeEventLoop) AePost(task func()) {
+	loop.post_mu.Lock()
+	if loop.closed {
+		loop.post_mu.Unlock()
+		return
+	}
+	// a single wakeup runs every task queued before it is handled
+	wakeup := len(loop.posted) == 0
+	loop.posted = append(loop.posted, task)
+	loop.post_mu.Unlock()
+	if !wakeup {
+		return
+	}
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	if _, err := unix.Write(loop.post_efd, one[:]); err != nil && err != unix.EAGAIN {
+		log.Printf("AePost write error: %v\n", err)
+	}
+}
+
+// aeRunPosted runs the tasks posted since the last wakeup, the ones they
+// post run on the next.
+func aeRunPosted(loop *AeEventLoop, fd int, mask FileEventType, extra interface{}) {
+	var count [8]byte
+	unix.Read(fd, count[:])
+	loop.post_mu.Lock()
+	tasks := loop.posted
+	loop.posted = nil
+	loop.post_mu.Unlock()
+	for _, task := range tasks {
+		task()
+	}
+}
+
+// AeGetPollerName returns the name of the backend the loop polls with.
+func (loop *AeEventLoop) AeGetPollerName() string {
+	return loop.poller.name()
 }
 
 func (loop *AeEventLoop) AeStop() {
 	loop.stop = true
 }
 
+// AeSetBeforeSleepProc sets a function called every time the loop is about
+// to wait for events, in place of the ones added so far. A nil proc removes
+// them all.
+func (loop *AeEventLoop) AeSetBeforeSleepProc(proc BeforeSleepProc) {
+	loop.beforesleep = nil
+	if proc != nil {
+		loop.beforesleep = append(loop.beforesleep, proc)
+	}
+}
+
+// AeAddBeforeSleepProc adds a function called every time the loop is about
+// to wait for events, after the ones added before it.
+func (loop *AeEventLoop) AeAddBeforeSleepProc(proc BeforeSleepProc) {
+	loop.beforesleep = append(loop.beforesleep, proc)
+}
+
+// AeAddAfterSleepProc adds a function called every time the loop wakes up,
+// before the events are processed and after the functions added before it.
+func (loop *AeEventLoop) AeAddAfterSleepProc(proc AfterSleepProc) {
+	loop.aftersleep = append(loop.aftersleep, proc)
+}
+
+// AeGetFileEvents returns the events registered for fd.
+func (loop *AeEventLoop) AeGetFileEvents(fd int) FileEventType {
+	fe, ok := loop.fileEvents[fd]
+	if !ok {
+		return AE_NONE
+	}
+	return fe.mask
+}
+
 func (loop *AeEventLoop) AeCreateFileEvent(fd int, mask FileEventType, proc FileProc, extra interface{}) error {
 	_, ok := loop.fileEvents[fd]
 	if !ok {
@@ -127,118 +306,54 @@ func (loop *AeEventLoop) AeCreateFileEvent(fd int, mask FileEventType, proc File
 	}
 
 	ev := loop.fileEvents[fd]
-	ev.mask |= AE_READABLE
+	old := ev.mask
+	if err := loop.aePollerUpdate(fd, old, old|mask); err != nil {
+		if old == AE_NONE {
+			delete(loop.fileEvents, fd)
+		}
+		return err
+	}
+	ev.mask |= mask
 	if mask&AE_READABLE == AE_READABLE {
 		ev.read_proc = proc
 	}
 	if mask&AE_WRITABLE == AE_WRITABLE {
 		ev.write_proc = proc
 	}
-
-	err := loop.aeEpollAdd(fd, mask)
-	if err != nil {
-		delete(loop.fileEvents, fd)
-		return err
-	}
 	return nil
 
 }
 
-func (loop *AeEventLoop) aeEpollAdd(fd int, mask FileEventType) error {
-	regop, ok := loop.epoll.regfd[fd]
-	var op int = 0
-	if ok && regop != 0 {
-		loop.epoll.regfd[fd] |= mask
-		op = unix.EPOLL_CTL_MOD
-	} else {
-		loop.epoll.regfd[fd] = mask
-		op = unix.EPOLL_CTL_ADD
-	}
-	var ev uint32 = 0
-	if regop&AE_READABLE == AE_READABLE {
-		ev |= unix.EPOLLIN
-	}
-	if regop&AE_WRITABLE == AE_WRITABLE {
-		ev |= unix.EPOLLOUT
-	}
-
-	if mask&AE_READABLE == AE_READABLE {
-		ev |= unix.EPOLLIN
-	}
-	if mask&AE_WRITABLE == AE_WRITABLE {
-		ev |= unix.EPOLLOUT
-	}
-	err := unix.EpollCtl(loop.epoll.epfd, op, fd, &unix.EpollEvent{
-		Fd:     int32(fd),
-		Events: ev,
-	})
-	if err != nil {
-		if ok {
-			loop.epoll.regfd[fd] = regop
-		} else {
-			delete(loop.epoll.regfd, fd)
-		}
-
-		return err
-	}
-	return nil
-}
-
 func (loop *AeEventLoop) AeDeleteFileEvent(fd int, mask FileEventType, extra interface{}) error {
-	_, ok := loop.fileEvents[fd]
+	ev, ok := loop.fileEvents[fd]
 	if !ok {
 		return nil
 	}
-	loop.fileEvents[fd].mask &^= mask
-
-	err := loop.aeEpollDelete(fd, mask)
-	if err != nil {
+	if err := loop.aePollerUpdate(fd, ev.mask, ev.mask&^mask); err != nil {
 		return err
 	}
-	if loop.fileEvents[fd].mask == AE_NONE {
+	ev.mask &^= mask
+	if ev.mask == AE_NONE {
 		delete(loop.fileEvents, fd)
 	}
 	return nil
 }
 
-func (loop *AeEventLoop) aeEpollDelete(fd int, mask FileEventType) error {
-	regop, ok := loop.epoll.regfd[fd]
-	var ev uint32 = 0
-	if !ok {
+// aePollerUpdate tells the poller the events of fd went from old to mask.
+func (loop *AeEventLoop) aePollerUpdate(fd int, old FileEventType, mask FileEventType) error {
+	switch {
+	case mask == old:
 		return nil
+	case old == AE_NONE:
+		return loop.poller.add(fd, mask)
+	case mask == AE_NONE:
+		return loop.poller.delete(fd)
 	}
-	if regop&AE_READABLE == AE_READABLE {
-		ev |= unix.EPOLLIN
-	}
-	if regop&AE_WRITABLE == AE_WRITABLE {
-		ev |= unix.EPOLLOUT
-	}
-	if mask&AE_READABLE == AE_READABLE {
-		ev &^= unix.EPOLLIN
-	}
-	if mask&AE_WRITABLE == AE_WRITABLE {
-		ev &^= unix.EPOLLOUT
-	}
-
-	if ev == 0 {
-		err := unix.EpollCtl(loop.epoll.epfd, unix.EPOLL_CTL_DEL, fd, nil)
-		if err != nil {
-			return err
-		}
-		delete(loop.epoll.regfd, fd)
-	} else {
-		err := unix.EpollCtl(loop.epoll.epfd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{
-			Fd:     int32(fd),
-			Events: ev,
-		})
-		if err != nil {
-			return err
-		}
-		loop.epoll.regfd[fd] &^= mask
-	}
-	return nil
+	return loop.poller.modify(fd, mask)
 }
 
+// AeCreateTimeEvent schedules proc at the absolute time milliseconds, AE_NORMAL
+// events are rescheduled after the interval proc returns.
 func (loop *AeEventLoop) AeCreateTimeEvent(milliseconds int, mask TimeEventType, proc TimeProc, extra interface{}) int {
 	var id int = loop.timeEventNextId
 	loop.timeEventNextId++
@@ -247,47 +362,40 @@ func (loop *AeEventLoop) AeCreateTimeEvent(milliseconds int, mask TimeEventType,
 		when:  milliseconds,
 		mask:  mask,
 		proc:  proc,
-		next:  nil,
 		extra: extra,
 	}
-	te.next = loop.timeEventHead
-	loop.timeEventHead = te
+	loop.timeEvents[id] = te
+	heap.Push(&loop.timers, te)
 
 	return id
 }
 
 func (loop *AeEventLoop) AeDeleteTimeEvent(id int) error {
-	var te, prev *AeTimeEvent = nil, nil
-	te = loop.timeEventHead
-	for te != nil {
-		if te.id == id {
-			if prev == nil {
-				loop.timeEventHead = te.next
-			} else {
-				prev.next = te.next
-			}
-			return nil
-		}
-		prev = te
-		te = te.next
+	te, ok := loop.timeEvents[id]
+	if !ok {
+		return AeErr{}
 	}
-	return AeErr{}
+	delete(loop.timeEvents, id)
+	// an event deleted by a proc of the same round was popped already
+	if te.index >= 0 {
+		heap.Remove(&loop.timers, te.index)
+	}
+	return nil
 }
 
 func (loop *AeEventLoop) aeProcessEvents() uint64 {
 	var processed uint64 = 0
-	if loop.epoll.readyEventCount > 0 {
-		for i := 0; i < loop.epoll.readyEventCount; i++ {
-			fd := loop.epoll.events[i].Fd
-			ev := loop.epoll.events[i].Events
-			//var repoll int = 0
-			if ev&unix.EPOLLIN == unix.EPOLLIN {
-				loop.fileEvents[int(fd)].read_proc(loop, int(fd), AE_READABLE, nil)
-				//repoll = 1
+	if len(loop.fired) > 0 {
+		for _, fired := range loop.fired {
+			fd := fired.fd
+			// a handler may delete the event, look it up before each call
+			fe, ok := loop.fileEvents[fd]
+			if ok && fe.mask&fired.mask&AE_READABLE == AE_READABLE {
+				fe.read_proc(loop, fd, AE_READABLE, fe.extra)
 			}
-
-			if ev&unix.EPOLLOUT == unix.EPOLLOUT {
-				loop.fileEvents[int(fd)].write_proc(loop, int(fd), AE_WRITABLE, nil)
+			fe, ok = loop.fileEvents[fd]
+			if ok && fe.mask&fired.mask&AE_WRITABLE == AE_WRITABLE {
+				fe.write_proc(loop, fd, AE_WRITABLE, fe.extra)
 			}
 		}
 		processed++
@@ -298,44 +406,46 @@ func (loop *AeEventLoop) aeProcessEvents() uint64 {
 	now := GetMsTime()
 	//handle time skew
 	if now < loop.lastTime {
-		te := loop.timeEventHead
-		for te != nil {
+		for _, te := range loop.timers {
 			te.when = 0
-			te = te.next
 		}
+		heap.Init(&loop.timers)
 	}
+	loop.lastTime = now
 
-	te := loop.timeEventHead
-	for te != nil {
-		now = GetMsTime()
-		if now > te.when {
-			re_exec := te.proc(loop, te.id, nil)
-			processed++
+	// pop the due events before firing any, so that an event rescheduled
+	// or created by a proc waits for the next round
+	var due []*AeTimeEvent
+	for len(loop.timers) > 0 && now > loop.timers[0].when {
+		due = append(due, heap.Pop(&loop.timers).(*AeTimeEvent))
+	}
+	for _, te := range due {
+		// a proc fired before may have deleted it
+		if loop.timeEvents[te.id] != te {
+			continue
+		}
+		re_exec := te.proc(loop, te.id, te.extra)
+		processed++
 
-			if te.mask&AE_NORMAL == AE_NORMAL {
-				te.when = GetMsTime() + re_exec
-			} else {
-				loop.AeDeleteTimeEvent(te.id)
-			}
-			te = loop.timeEventHead
+		if loop.timeEvents[te.id] != te {
+			continue
+		}
+		if te.mask&AE_NORMAL == AE_NORMAL {
+			te.when = GetMsTime() + re_exec
+			heap.Push(&loop.timers, te)
 		} else {
-			te = te.next
+			delete(loop.timeEvents, te.id)
 		}
-
 	}
 
 	return processed
 }
 
 func (loop *AeEventLoop) aeSearchNearestTimer() *AeTimeEvent {
-	var te, nearest *AeTimeEvent = loop.timeEventHead, nil
-	for te != nil {
-		if nearest == nil || te.when < nearest.when {
-			nearest = te
-		}
-		te = te.next
+	if len(loop.timers) == 0 {
+		return nil
 	}
-	return nearest
+	return loop.timers[0]
 }
 
 func GetMsTime() int {
@@ -359,18 +469,24 @@ func calTimeInterval(loop *AeEventLoop) int {
 
 func (loop *AeEventLoop) aeWait() {
 	wait_time := calTimeInterval(loop)
-	n, err := unix.EpollWait(loop.epoll.epfd, loop.epoll.events, wait_time)
+	fired, err := loop.poller.wait(wait_time)
 	if err != nil && err != unix.EINTR {
-		log.Panicf("EpollWait: %v\n", err)
+		log.Panicf("%s wait: %v\n", loop.poller.name(), err)
 	}
-	loop.epoll.readyEventCount = n
+	loop.fired = fired
 
 }
 
 func (loop *AeEventLoop) AeMain() {
 	loop.stop = false
 	for !loop.stop {
+		for _, proc := range loop.beforesleep {
+			proc(loop)
+		}
 		loop.aeWait()
+		for _, proc := range loop.aftersleep {
+			proc(loop)
+		}
 		loop.aeProcessEvents()
 	}
 }
@@ -0,0 +1,85 @@
+package godis
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// EpollState is the default poller, backed by epoll(7).
+type EpollState struct {
+	epfd   int
+	events []unix.EpollEvent
+	fired  []AeFiredEvent
+}
+
+func newEpollPoller() (*EpollState, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &EpollState{
+		epfd:   epfd,
+		events: make([]unix.EpollEvent, 1024),
+		fired:  make([]AeFiredEvent, 0, 1024),
+	}, nil
+}
+
+func epollEvents(mask FileEventType) uint32 {
+	var ev uint32 = 0
+	if mask&AE_READABLE == AE_READABLE {
+		ev |= unix.EPOLLIN
+	}
+	if mask&AE_WRITABLE == AE_WRITABLE {
+		ev |= unix.EPOLLOUT
+	}
+	return ev
+}
+
+func (p *EpollState) add(fd int, mask FileEventType) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+		Fd:     int32(fd),
+		Events: epollEvents(mask),
+	})
+}
+
+func (p *EpollState) modify(fd int, mask FileEventType) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{
+		Fd:     int32(fd),
+		Events: epollEvents(mask),
+	})
+}
+
+func (p *EpollState) delete(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *EpollState) wait(timeout int) ([]AeFiredEvent, error) {
+	n, err := unix.EpollWait(p.epfd, p.events, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.fired = p.fired[:0]
+	for _, e := range p.events[:n] {
+		var mask FileEventType = AE_NONE
+		if e.Events&unix.EPOLLIN == unix.EPOLLIN {
+			mask |= AE_READABLE
+		}
+		if e.Events&unix.EPOLLOUT == unix.EPOLLOUT {
+			mask |= AE_WRITABLE
+		}
+		// errors and hangups are reported to whichever handler is
+		// installed so that it notices the failure on its next syscall
+		if e.Events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+			mask |= AE_READABLE | AE_WRITABLE
+		}
+		p.fired = append(p.fired, AeFiredEvent{fd: int(e.Fd), mask: mask})
+	}
+	return p.fired, nil
+}
+
+func (p *EpollState) close() error {
+	return unix.Close(p.epfd)
+}
+
+func (p *EpollState) name() string {
+	return AE_POLLER_EPOLL
+}
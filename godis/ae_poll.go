@@ -0,0 +1,97 @@
+package godis
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// PollState is the portable poller, backed by poll(2). Every wait hands the
+// whole set of descriptors to the kernel, so it scales worse than epoll with
+// many connections, but it only needs a syscall that sandboxes and seccomp
+// profiles hardly ever forbid.
+type PollState struct {
+	fds   []unix.PollFd
+	index map[int]int // position of a descriptor in fds
+	fired []AeFiredEvent
+}
+
+func newPollPoller() *PollState {
+	return &PollState{
+		index: make(map[int]int),
+	}
+}
+
+func pollEvents(mask FileEventType) int16 {
+	var ev int16 = 0
+	if mask&AE_READABLE == AE_READABLE {
+		ev |= unix.POLLIN
+	}
+	if mask&AE_WRITABLE == AE_WRITABLE {
+		ev |= unix.POLLOUT
+	}
+	return ev
+}
+
+func (p *PollState) add(fd int, mask FileEventType) error {
+	if _, ok := p.index[fd]; ok {
+		return unix.EEXIST
+	}
+	p.index[fd] = len(p.fds)
+	p.fds = append(p.fds, unix.PollFd{Fd: int32(fd), Events: pollEvents(mask)})
+	return nil
+}
+
+func (p *PollState) modify(fd int, mask FileEventType) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	p.fds[i].Events = pollEvents(mask)
+	return nil
+}
+
+func (p *PollState) delete(fd int) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	last := len(p.fds) - 1
+	p.fds[i] = p.fds[last]
+	p.index[int(p.fds[i].Fd)] = i
+	p.fds = p.fds[:last]
+	delete(p.index, fd)
+	return nil
+}
+
+func (p *PollState) wait(timeout int) ([]AeFiredEvent, error) {
+	n, err := unix.Poll(p.fds, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.fired = p.fired[:0]
+	for i := 0; i < len(p.fds) && len(p.fired) < n; i++ {
+		revents := p.fds[i].Revents
+		if revents == 0 {
+			continue
+		}
+		var mask FileEventType = AE_NONE
+		if revents&unix.POLLIN == unix.POLLIN {
+			mask |= AE_READABLE
+		}
+		if revents&unix.POLLOUT == unix.POLLOUT {
+			mask |= AE_WRITABLE
+		}
+		if revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0 {
+			mask |= AE_READABLE | AE_WRITABLE
+		}
+		p.fired = append(p.fired, AeFiredEvent{fd: int(p.fds[i].Fd), mask: mask})
+	}
+	return p.fired, nil
+}
+
+func (p *PollState) close() error {
+	return nil
+}
+
+func (p *PollState) name() string {
+	return AE_POLLER_POLL
+}
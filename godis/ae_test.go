@@ -1,8 +1,14 @@
 package godis
 
 import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestAeErr(t *testing.T) {
@@ -30,8 +36,11 @@ func TestAeCreateEventLoop(t *testing.T) {
 	if loop == nil {
 		t.Fatal("AeCreateEventLoop() returned a nil loop.")
 	}
-	if loop.epoll == nil {
-		t.Fatal("AeCreateEventLoop() did not initialize the epoll state.")
+	if loop.AeGetPollerName() != AE_POLLER_EPOLL {
+		t.Fatalf("AeCreateEventLoop() polls with %s, not epoll.", loop.AeGetPollerName())
+	}
+	if _, err := AeCreateEventLoopWithPoller("select"); err == nil {
+		t.Fatal("AeCreateEventLoopWithPoller() accepted an unknown poller.")
 	}
 }
 
@@ -87,21 +96,84 @@ func TestGetMsTime(t *testing.T) {
 	}
 }
 
-func TestAeEpollAdd(t *testing.T) {
-	loop, _ := AeCreateEventLoop()
-	err := loop.aeEpollAdd(1, AE_READABLE)
-	if err != nil {
-		t.Fatalf("aeEpollAdd() returned an error: %v", err)
+// testPollers runs test against a loop of every poller.
+func testPollers(t *testing.T, test func(t *testing.T, loop *AeEventLoop)) {
+	for _, name := range []string{AE_POLLER_EPOLL, AE_POLLER_POLL} {
+		t.Run(name, func(t *testing.T) {
+			loop, err := AeCreateEventLoopWithPoller(name)
+			if err != nil {
+				t.Fatalf("AeCreateEventLoopWithPoller() returned an error: %v", err)
+			}
+			defer loop.AeDeleteEventLoop()
+			test(t, loop)
+		})
 	}
 }
 
-func TestAeEpollDelete(t *testing.T) {
-	loop, _ := AeCreateEventLoop()
-	loop.aeEpollAdd(1, AE_READABLE)
-	err := loop.aeEpollDelete(1, AE_READABLE)
-	if err != nil {
-		t.Fatalf("aeEpollDelete() returned an error: %v", err)
-	}
+func TestAePollerAdd(t *testing.T) {
+	testPollers(t, func(t *testing.T, loop *AeEventLoop) {
+		if err := loop.poller.add(1, AE_READABLE); err != nil {
+			t.Fatalf("add() returned an error: %v", err)
+		}
+		if err := loop.poller.add(1, AE_READABLE); err == nil {
+			t.Fatal("add() registered a descriptor twice")
+		}
+	})
+}
+
+func TestAePollerDelete(t *testing.T) {
+	testPollers(t, func(t *testing.T, loop *AeEventLoop) {
+		loop.poller.add(1, AE_READABLE)
+		if err := loop.poller.delete(1); err != nil {
+			t.Fatalf("delete() returned an error: %v", err)
+		}
+		if err := loop.poller.modify(1, AE_WRITABLE); err == nil {
+			t.Fatal("modify() changed a deleted descriptor")
+		}
+	})
+}
+
+func TestAeFileEvents(t *testing.T) {
+	testPollers(t, func(t *testing.T, loop *AeEventLoop) {
+		var p [2]int
+		if err := unix.Pipe2(p[:], unix.O_NONBLOCK); err != nil {
+			t.Fatalf("Pipe2() returned an error: %v", err)
+		}
+		defer unix.Close(p[0])
+		defer unix.Close(p[1])
+
+		var fired []string
+		record := func(loop *AeEventLoop, fd int, mask FileEventType, extra interface{}) {
+			fired = append(fired, fmt.Sprintf("%d:%d", fd, mask))
+		}
+		loop.AeCreateFileEvent(p[0], AE_READABLE, record, nil)
+		loop.AeCreateFileEvent(p[1], AE_WRITABLE, record, nil)
+		loop.aeWait()
+		loop.aeProcessEvents()
+		if want := fmt.Sprintf("%d:%d", p[1], AE_WRITABLE); strings.Join(fired, ",") != want {
+			t.Fatalf("fired %v, expected %s", fired, want)
+		}
+
+		fired = nil
+		loop.AeDeleteFileEvent(p[1], AE_WRITABLE, nil)
+		unix.Write(p[1], []byte("x"))
+		loop.aeWait()
+		loop.aeProcessEvents()
+		if want := fmt.Sprintf("%d:%d", p[0], AE_READABLE); strings.Join(fired, ",") != want {
+			t.Fatalf("fired %v, expected %s", fired, want)
+		}
+		if loop.AeGetFileEvents(p[1]) != AE_NONE {
+			t.Fatal("AeDeleteFileEvent() left the writable event registered")
+		}
+
+		fired = nil
+		loop.AeDeleteFileEvent(p[0], AE_READABLE, nil)
+		loop.aeWait()
+		loop.aeProcessEvents()
+		if len(fired) != 0 {
+			t.Fatalf("fired %v after every event was deleted", fired)
+		}
+	})
 }
 
 func TestAeProcessEvents(t *testing.T) {
@@ -122,6 +194,52 @@ func TestAeSearchNearestTimer(t *testing.T) {
 	}
 }
 
+func TestAeTimeEventOrder(t *testing.T) {
+	loop, _ := AeCreateEventLoop()
+	var fired []int
+	var ids []int
+	proc := func(loop *AeEventLoop, id int, extra interface{}) int {
+		fired = append(fired, id)
+		// the first event to fire deletes the last one created
+		if len(fired) == 1 {
+			loop.AeDeleteTimeEvent(ids[len(ids)-1])
+		}
+		return 1000
+	}
+	now := GetMsTime()
+	for i := 0; i < 1000; i++ {
+		mask := AE_ONCE
+		if i%2 == 0 {
+			mask = AE_NORMAL
+		}
+		ids = append(ids, loop.AeCreateTimeEvent(now-1-(i*7)%1000, mask, proc, nil))
+	}
+	if err := loop.AeDeleteTimeEvent(ids[500]); err != nil {
+		t.Fatalf("AeDeleteTimeEvent() returned an error: %v", err)
+	}
+	if err := loop.AeDeleteTimeEvent(ids[500]); err == nil {
+		t.Fatal("AeDeleteTimeEvent() deleted an event twice")
+	}
+
+	loop.aeProcessEvents()
+	if len(fired) != 998 {
+		t.Fatalf("aeProcessEvents() fired %d events, expected 998", len(fired))
+	}
+	when := func(id int) int { return now - 1 - ((id-1)*7)%1000 }
+	for i := 1; i < len(fired); i++ {
+		if when(fired[i-1]) > when(fired[i]) {
+			t.Fatalf("event %d fired before event %d", fired[i-1], fired[i])
+		}
+	}
+	// the AE_ONCE events are gone, the AE_NORMAL ones are a second away
+	if len(loop.timers) != 499 || len(loop.timeEvents) != 499 {
+		t.Fatalf("%d events left in the heap, %d in total, expected 499", len(loop.timers), len(loop.timeEvents))
+	}
+	if nearest := loop.aeSearchNearestTimer(); nearest.when < now+1000 {
+		t.Fatalf("the nearest timer is due at %d, before %d", nearest.when, now+1000)
+	}
+}
+
 func TestCalTimeInterval(t *testing.T) {
 	loop, _ := AeCreateEventLoop()
 	loop.AeCreateTimeEvent(GetMsTime()+200, AE_NORMAL, nil, nil)
@@ -131,9 +249,75 @@ func TestCalTimeInterval(t *testing.T) {
 	}
 }
 
+func TestAeSleepHooks(t *testing.T) {
+	loop, _ := AeCreateEventLoop()
+	var calls []string
+	hook := func(name string) func(loop *AeEventLoop) {
+		return func(loop *AeEventLoop) {
+			calls = append(calls, name)
+		}
+	}
+	loop.AeSetBeforeSleepProc(hook("replaced"))
+	loop.AeSetBeforeSleepProc(hook("before1"))
+	loop.AeAddBeforeSleepProc(hook("before2"))
+	loop.AeAddAfterSleepProc(hook("after1"))
+	loop.AeAddAfterSleepProc(hook("after2"))
+	loop.AeCreateTimeEvent(0, AE_ONCE, func(loop *AeEventLoop, id int, extra interface{}) int {
+		calls = append(calls, "timer")
+		loop.AeStop()
+		return 0
+	}, nil)
+	loop.AeMain()
+	if got := strings.Join(calls, ","); got != "before1,before2,after1,after2,timer" {
+		t.Fatalf("AeMain() called %s", got)
+	}
+}
+
 func TestAeMain(t *testing.T) {
 	loop, _ := AeCreateEventLoop()
 	go loop.AeMain() // Start the event loop in a separate goroutine
 	time.Sleep(10 * time.Millisecond)
-	loop.AeStop() // Stop the event loop
+	loop.AePost(loop.AeStop) // Stop the event loop from its goroutine
+}
+
+func TestAePost(t *testing.T) {
+	testPollers(t, func(t *testing.T, loop *AeEventLoop) {
+		// the loop waits for an hour unless a post wakes it up
+		loop.AeCreateTimeEvent(GetMsTime()+3600*1000, AE_ONCE, nil, nil)
+		done := make(chan struct{})
+		go func() {
+			loop.AeMain()
+			close(done)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		const posters = 8
+		const tasks = 100
+		var wg sync.WaitGroup
+		order := make([][]int, posters)
+		for i := 0; i < posters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < tasks; j++ {
+					loop.AePost(func() { order[i] = append(order[i], j) })
+				}
+			}()
+		}
+		wg.Wait()
+		loop.AePost(loop.AeStop)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("AePost() didn't wake the loop up")
+		}
+		for i := range order {
+			if len(order[i]) != tasks || !slices.IsSorted(order[i]) {
+				t.Fatalf("poster %d: the loop ran %v", i, order[i])
+			}
+		}
+
+		loop.AeDeleteEventLoop()
+		loop.AePost(func() { t.Fatal("a task was posted to a deleted loop") })
+	})
 }
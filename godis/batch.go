@@ -0,0 +1,138 @@
+package godis
+
+import (
+	"fmt"
+	myProto "godisdb/proto"
+	"strings"
+)
+
+// keySnapshot is the state of a key before an atomic batch touched it.
+type keySnapshot struct {
+	obj        *GodisObj // nil if the key didn't exist
+	expire     int
+	has_expire bool
+}
+
+// checkAtomicBatch validates every command of an atomic batch before any of
+// them runs, returns an empty string when the batch can run.
+func checkAtomicBatch(c *GodisClient, batch *myProto.CmdBatch) string {
+	for i, cmd := range batch.Cmds {
+		name := strings.ToLower(string(cmd.Command))
+		command, ok := CommandTable[name]
+		if !ok {
+			return fmt.Sprintf("ERR unknown command '%s' at position %d", name, i+1)
+		}
+		// only commands whose effects are limited to their keys can be
+		// rolled back
+		if command.mask&(READ_COMMAND|WRITE_COMMAND) == 0 {
+			return fmt.Sprintf("ERR '%s' is not allowed in an atomic batch at position %d", name, i+1)
+		}
+		if !arityOk(command, len(cmd.Args)) {
+			return fmt.Sprintf("ERR wrong number of arguments for '%s' command at position %d", name, i+1)
+		}
+	}
+	if server.requirepass != "" && !c.authenticated {
+		return str_err_noauth
+	}
+	return ""
+}
+
+// snapshotKeys saves the object of every key the batch may touch. Objects
+// aren't copied up front: the command changing one gives its key a copy
+// first, see unshareObject, and the saved object is left as it was.
+func snapshotKeys(db *GodisDB, batch *myProto.CmdBatch) map[string]keySnapshot {
+	snapshot := make(map[string]keySnapshot)
+	for _, cmd := range batch.Cmds {
+		command := CommandTable[strings.ToLower(string(cmd.Command))]
+		for _, key := range getKeysFromCommand(command, bytesToStrings(cmd.Args)) {
+			if _, ok := snapshot[key]; ok {
+				continue
+			}
+			var s keySnapshot
+			if obj, ok := db.dict[key]; ok {
+				s.obj = obj
+				obj.snapshots++
+			}
+			s.expire, s.has_expire = db.expires[key]
+			snapshot[key] = s
+		}
+	}
+	return snapshot
+}
+
+// releaseKeys lets the commands change the saved objects in place again.
+func releaseKeys(snapshot map[string]keySnapshot) {
+	for _, s := range snapshot {
+		if s.obj != nil {
+			s.obj.snapshots--
+		}
+	}
+}
+
+func restoreKeys(db *GodisDB, snapshot map[string]keySnapshot) {
+	for key, s := range snapshot {
+		if s.obj == nil {
+			delete(db.dict, key)
+		} else {
+			db.dict[key] = s.obj
+		}
+		if s.has_expire {
+			db.expires[key] = s.expire
+		} else {
+			delete(db.expires, key)
+		}
+	}
+}
+
+// processCmdBatch runs the commands of a batch back to back and replies with
+// an array holding the reply of each one. An atomic batch that fails is
+// rolled back and replied with a single EXECABORT error.
+func processCmdBatch(c *GodisClient, batch *myProto.CmdBatch) {
+	c.last_interaction = GetMsTime()
+	// a batch runs as a whole on the shard owning its keys
+	if len(server.shards) > 1 {
+		target, ok := getBatchShard(batch)
+		if !ok {
+			addReply(c, errorValue(str_err_crossslot))
+			return
+		}
+		if target != nil && target != c.shard {
+			forwardToShard(c, target, func(fc *GodisClient) { processCmdBatch(fc, batch) })
+			return
+		}
+	}
+	var snapshot map[string]keySnapshot
+	if batch.Atomic {
+		if err := checkAtomicBatch(c, batch); err != "" {
+			addReply(c, errorValue("EXECABORT Transaction discarded because of: "+err))
+			return
+		}
+		snapshot = snapshotKeys(c.db, batch)
+	}
+
+	// the replies of the commands are collected instead of being sent, a
+	// batch forwarded from another shard runs on a client that collects
+	// replies already
+	outer := c.batch_replies
+	c.batch_replies = make([]*myProto.Value, 0, len(batch.Cmds))
+	failed := -1
+	for i, cmd := range batch.Cmds {
+		loadCmd(c, cmd)
+		processClientCommand(c)
+		if batch.Atomic && len(c.batch_replies) > 0 && c.batch_replies[len(c.batch_replies)-1].GetError() != "" {
+			failed = i
+			break
+		}
+	}
+	replies := c.batch_replies
+	c.batch_replies = outer
+
+	releaseKeys(snapshot)
+	if failed >= 0 {
+		restoreKeys(c.db, snapshot)
+		err := replies[len(replies)-1].GetError()
+		addReply(c, errorValue(fmt.Sprintf("EXECABORT Transaction rolled back because command %d failed: %s", failed+1, err)))
+		return
+	}
+	addReply(c, arrayValue(replies...))
+}
@@ -0,0 +1,145 @@
+package godis
+
+import (
+	"bufio"
+	myProto "godisdb/proto"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func appendBatch(buf []byte, atomic bool, cmds ...[]string) []byte {
+	batch := &myProto.CmdBatch{Atomic: atomic}
+	for _, cmd := range cmds {
+		batch.Cmds = append(batch.Cmds, &myProto.Cmd{
+			Command: []byte(cmd[0]),
+			Args:    stringsToBytes(cmd[1:]),
+		})
+	}
+	frame, _ := proto.Marshal(&myProto.Cmd{Batch: batch, Version: PROTOBUF_VERSION})
+	buf = protowire.AppendVarint(buf, uint64(len(frame)))
+	return append(buf, frame...)
+}
+
+func TestCmdBatch(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// a failing command doesn't stop a non atomic batch
+	conn.Write(appendBatch(nil, false,
+		[]string{"set", "a", "1"},
+		[]string{"lpush", "a", "x"},
+		[]string{"get", "a"}))
+	replies := readReply(t, r).GetArray().GetValues()
+	if len(replies) != 3 || replies[0].GetStatus() != "OK" ||
+		!strings.HasPrefix(replies[1].GetError(), "WRONGTYPE") || string(replies[2].GetBulk()) != "1" {
+		t.Fatalf("the batch returned %v", replies)
+	}
+
+	conn.Write(appendBatch(nil, true,
+		[]string{"set", "b", "2"},
+		[]string{"rpush", "l", "x", "y"},
+		[]string{"get", "b"}))
+	replies = readReply(t, r).GetArray().GetValues()
+	if len(replies) != 3 || replies[1].GetInteger() != 2 || string(replies[2].GetBulk()) != "2" {
+		t.Fatalf("the atomic batch returned %v", replies)
+	}
+}
+
+func TestAtomicCmdBatchRollback(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	setup := [][]string{
+		{"set", "str", "v"},
+		{"rpush", "list", "a"},
+		{"hset", "hash", "f", "v"},
+		{"sadd", "set", "a"},
+		{"zadd", "zset", "1", "a"},
+	}
+	conn.Write(appendBatch(nil, false, setup...))
+	readReply(t, r)
+
+	// the last command fails, everything before it is rolled back
+	conn.Write(appendBatch(nil, true,
+		[]string{"set", "str", "changed"},
+		[]string{"rpush", "list", "b"},
+		[]string{"hset", "hash", "f", "changed"},
+		[]string{"sadd", "set", "b"},
+		[]string{"zadd", "zset", "2", "b"},
+		[]string{"set", "new", "v"},
+		[]string{"lpush", "str", "x"}))
+	if err := readReply(t, r).GetError(); !strings.HasPrefix(err, "EXECABORT") {
+		t.Fatalf("the failed batch returned %q", err)
+	}
+
+	// a batch with a malformed command doesn't run at all
+	conn.Write(appendBatch(nil, true,
+		[]string{"set", "str", "changed"},
+		[]string{"get"}))
+	if err := readReply(t, r).GetError(); !strings.HasPrefix(err, "EXECABORT") {
+		t.Fatalf("the malformed batch returned %q", err)
+	}
+	conn.Write(appendBatch(nil, true, []string{"publish", "news", "hi"}))
+	if err := readReply(t, r).GetError(); !strings.HasPrefix(err, "EXECABORT") {
+		t.Fatalf("publish in an atomic batch returned %q", err)
+	}
+
+	conn.Write(appendBatch(nil, false,
+		[]string{"get", "str"},
+		[]string{"lrange", "list", "0", "-1"},
+		[]string{"hget", "hash", "f"},
+		[]string{"smembers", "set"},
+		[]string{"zrange", "zset", "0", "10"},
+		[]string{"exists", "new"}))
+	var got []string
+	for _, v := range readReply(t, r).GetArray().GetValues() {
+		got = append(got, strings.Join(bytesToStrings(flattenValue(nil, v)), ","))
+	}
+	want := []string{"v", "a", "v", "a", "a", "0"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("after the rollback got %q, want %q", got, want)
+	}
+}
+
+func TestAtomicCmdBatchCopiesChangedKeys(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write(appendBatch(nil, false,
+		[]string{"hset", "read", "f", "v"},
+		[]string{"hset", "changed", "f", "v"}))
+	readReply(t, r)
+	objects := func() (read *GodisObj, changed *GodisObj) {
+		done := make(chan struct{})
+		server.shards[0].loop.AePost(func() {
+			read, changed = server.shards[0].db[0].dict["read"], server.shards[0].db[0].dict["changed"]
+			close(done)
+		})
+		<-done
+		return
+	}
+	read, changed := objects()
+
+	// only the object a command changes is copied, the others are left
+	// alone
+	conn.Write(appendBatch(nil, true,
+		[]string{"hget", "read", "f"},
+		[]string{"hset", "changed", "f", "new"}))
+	readReply(t, r)
+	readAfter, changedAfter := objects()
+	if readAfter != read || read.snapshots != 0 {
+		t.Errorf("the object only read was copied or is still saved")
+	}
+	if changedAfter == changed || changed.val.(GodisHash)["f"].val != "v" {
+		t.Errorf("the saved object was changed in place")
+	}
+}
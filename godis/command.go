@@ -6,6 +6,7 @@ import (
 	myProto "godisdb/proto"
 	"log"
 	"strconv"
+	"strings"
 )
 
 type CommandProc func(c *GodisClient)
@@ -13,9 +14,10 @@ type CommandProc func(c *GodisClient)
 type CommandType int
 
 const (
-	WRITE_COMMAND CommandType = 0x01
-	READ_COMMAND  CommandType = 0x02
-	ADMIN_COMMAND CommandType = 0x04
+	WRITE_COMMAND  CommandType = 0x01
+	READ_COMMAND   CommandType = 0x02
+	ADMIN_COMMAND  CommandType = 0x04
+	PUBSUB_COMMAND CommandType = 0x08
 )
 
 type GodisCommand struct {
@@ -26,48 +28,61 @@ type GodisCommand struct {
 	microseconds int
 	calls        int
 	arity_more   bool
+	// positions of the keys in the command line, the command name being 0.
+	// lastkey -1 means the last argument, firstkey 0 means no keys.
+	firstkey int
+	lastkey  int
+	keystep  int
 }
 
 var CommandTable map[string]GodisCommand
 
 func initCommandTable() {
 	CommandTable = map[string]GodisCommand{
-		"ping":   {"ping", pingCommand, 1, ADMIN_COMMAND, 0, 0, false},
-		"get":    {"get", getCommand, 2, READ_COMMAND, 0, 0, false},
-		"set":    {"set", setCommand, 3, WRITE_COMMAND, 0, 0, false},
-		"del":    {"del", delCommand, 2, WRITE_COMMAND, 0, 0, true},
-		"exists": {"exists", existsCommand, 2, READ_COMMAND, 0, 0, true},
-		"expire": {"expire", expireCommand, 3, WRITE_COMMAND, 0, 0, false},
-
-		"lpush":  {"lpush", lpushCommand, 3, WRITE_COMMAND, 0, 0, true},
-		"rpush":  {"rpush", rpushCommand, 3, WRITE_COMMAND, 0, 0, true},
-		"lpop":   {"lpop", lpopCommand, 2, WRITE_COMMAND, 0, 0, false},
-		"rpop":   {"rpop", rpopCommand, 2, WRITE_COMMAND, 0, 0, false},
-		"llen":   {"llen", llenCommand, 2, READ_COMMAND, 0, 0, false},
-		"lindex": {"lindex", lindexCommand, 3, READ_COMMAND, 0, 0, false},
-		"lset":   {"lset", lsetCommand, 4, WRITE_COMMAND, 0, 0, false},
-		"lrange": {"lrange", lrangeCommand, 4, READ_COMMAND, 0, 0, false},
-
-		"hset":    {"hset", hsetCommand, 4, WRITE_COMMAND, 0, 0, true}, //need more check count%2
-		"hget":    {"hget", hgetCommand, 3, READ_COMMAND, 0, 0, false},
-		"hexists": {"hexists", hexistsCommand, 3, READ_COMMAND, 0, 0, false},
-		"hdel":    {"hdel", hdelCommand, 3, WRITE_COMMAND, 0, 0, true},
-		"hlen":    {"hlen", hlenCommand, 2, READ_COMMAND, 0, 0, false},
-		"hgetall": {"hgetall", hgetallCommand, 2, READ_COMMAND, 0, 0, false},
-
-		"sadd":      {"sadd", saddCommand, 3, WRITE_COMMAND, 0, 0, true},
-		"scard":     {"scard", scardCommand, 2, READ_COMMAND, 0, 0, false},
-		"sismember": {"sismember", sismemberCommand, 3, READ_COMMAND, 0, 0, false},
-		"smembers":  {"smembers", sinterCommand, 2, READ_COMMAND, 0, 0, false},
-		"srem":      {"srem", sremCommand, 3, WRITE_COMMAND, 0, 0, true},
-
-		"zadd":   {"zadd", zaddCommand, 4, WRITE_COMMAND, 0, 0, true},
-		"zcard":  {"zcard", zcardCommand, 2, READ_COMMAND, 0, 0, false},
-		"zcount": {"zcount", zcountCommand, 4, READ_COMMAND, 0, 0, false},
-		"zrange": {"zrange", zrangeCommand, 4, READ_COMMAND, 0, 0, false},
-		"zrank":  {"zrank", zrankCommand, 3, READ_COMMAND, 0, 0, false},
-		"zrem":   {"zrem", zremCommand, 3, WRITE_COMMAND, 0, 0, true},
-		"zscore": {"zscore", zscoreCommand, 3, READ_COMMAND, 0, 0, false},
+		"ping":   {"ping", pingCommand, 1, ADMIN_COMMAND, 0, 0, false, 0, 0, 0},
+		"auth":   {"auth", authCommand, 2, ADMIN_COMMAND, 0, 0, true, 0, 0, 0},
+		"hello":  {"hello", helloCommand, 1, ADMIN_COMMAND, 0, 0, true, 0, 0, 0},
+		"info":   {"info", infoCommand, 1, ADMIN_COMMAND, 0, 0, true, 0, 0, 0},
+		"client": {"client", clientCommand, 2, ADMIN_COMMAND, 0, 0, true, 0, 0, 0},
+		"get":    {"get", getCommand, 2, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"set":    {"set", setCommand, 3, WRITE_COMMAND, 0, 0, false, 1, 1, 1},
+		"del":    {"del", delCommand, 2, WRITE_COMMAND, 0, 0, true, 1, -1, 1},
+		"exists": {"exists", existsCommand, 2, READ_COMMAND, 0, 0, true, 1, -1, 1},
+		"expire": {"expire", expireCommand, 3, WRITE_COMMAND, 0, 0, false, 1, 1, 1},
+
+		"lpush":  {"lpush", lpushCommand, 3, WRITE_COMMAND, 0, 0, true, 1, 1, 1},
+		"rpush":  {"rpush", rpushCommand, 3, WRITE_COMMAND, 0, 0, true, 1, 1, 1},
+		"lpop":   {"lpop", lpopCommand, 2, WRITE_COMMAND, 0, 0, false, 1, 1, 1},
+		"rpop":   {"rpop", rpopCommand, 2, WRITE_COMMAND, 0, 0, false, 1, 1, 1},
+		"llen":   {"llen", llenCommand, 2, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"lindex": {"lindex", lindexCommand, 3, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"lset":   {"lset", lsetCommand, 4, WRITE_COMMAND, 0, 0, false, 1, 1, 1},
+		"lrange": {"lrange", lrangeCommand, 4, READ_COMMAND, 0, 0, false, 1, 1, 1},
+
+		"hset":    {"hset", hsetCommand, 4, WRITE_COMMAND, 0, 0, true, 1, 1, 1}, //need more check count%2
+		"hget":    {"hget", hgetCommand, 3, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"hexists": {"hexists", hexistsCommand, 3, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"hdel":    {"hdel", hdelCommand, 3, WRITE_COMMAND, 0, 0, true, 1, 1, 1},
+		"hlen":    {"hlen", hlenCommand, 2, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"hgetall": {"hgetall", hgetallCommand, 2, READ_COMMAND, 0, 0, false, 1, 1, 1},
+
+		"sadd":      {"sadd", saddCommand, 3, WRITE_COMMAND, 0, 0, true, 1, 1, 1},
+		"scard":     {"scard", scardCommand, 2, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"sismember": {"sismember", sismemberCommand, 3, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"smembers":  {"smembers", sinterCommand, 2, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"srem":      {"srem", sremCommand, 3, WRITE_COMMAND, 0, 0, true, 1, 1, 1},
+
+		"zadd":   {"zadd", zaddCommand, 4, WRITE_COMMAND, 0, 0, true, 1, 1, 1},
+		"zcard":  {"zcard", zcardCommand, 2, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"zcount": {"zcount", zcountCommand, 4, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"zrange": {"zrange", zrangeCommand, 4, READ_COMMAND, 0, 0, true, 1, 1, 1},
+		"zrank":  {"zrank", zrankCommand, 3, READ_COMMAND, 0, 0, false, 1, 1, 1},
+		"zrem":   {"zrem", zremCommand, 3, WRITE_COMMAND, 0, 0, true, 1, 1, 1},
+		"zscore": {"zscore", zscoreCommand, 3, READ_COMMAND, 0, 0, false, 1, 1, 1},
+
+		"subscribe":   {"subscribe", subscribeCommand, 2, PUBSUB_COMMAND, 0, 0, true, 0, 0, 0},
+		"unsubscribe": {"unsubscribe", unsubscribeCommand, 1, PUBSUB_COMMAND, 0, 0, true, 0, 0, 0},
+		"publish":     {"publish", publishCommand, 3, PUBSUB_COMMAND, 0, 0, false, 0, 0, 0},
 	}
 }
 
@@ -90,66 +105,66 @@ var str_err_wrongtype string = "WRONGTYPE Operation against a key holding the wr
 var str_err_outrange string = "ERR value is not an integer or out of range"
 var str_err_nokey string = "ERR no such key"
 var str_err_notfloat string = "ERR value is not a valid float"
-
+var str_err_noauth string = "NOAUTH Authentication required."
+var str_err_wrongpass string = "WRONGPASS invalid username-password pair or user is disabled."
+var str_err_nopass string = "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"
+var str_err_noproto string = "NOPROTO unsupported protocol version"
+var str_err_syntax string = "ERR syntax error"
+var str_err_notutf8 string = "ERR reply is not valid UTF-8, a client speaking protocol version 1 is required"
+var str_err_maxclients string = "ERR max number of clients reached"
+
+// genReply queues a reply of the given type, s holds the string of
+// RE_OK, RE_ERR and RE_STRING, d the integer of RE_INT and slice the
+// elements of aggregates.
 func genReply(c *GodisClient, re_type ReplyType, s *string, d int, slice []string) {
 	switch re_type {
 	case RE_NONE:
-		c.reply = append(c.reply, myProto.Reply{
-			ReplyType: int64(RE_NONE),
-		})
+		addReply(c, nullValue())
 	case RE_OK:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      []string{*s},
-			ReplyType: int64(RE_OK),
-		})
+		addReply(c, statusValue(*s))
 	case RE_ERR:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      []string{*s},
-			ReplyType: int64(RE_ERR),
-		})
+		addReply(c, errorValue(*s))
 	case RE_STRING:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      []string{*s},
-			ReplyType: int64(RE_STRING),
-		})
+		addReply(c, bulkValue(*s))
 	case RE_INT:
-		tmp := fmt.Sprintf("%d", d)
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      []string{tmp},
-			ReplyType: int64(RE_INT),
-		})
+		addReply(c, integerValue(int64(d)))
 	case RE_HASH:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      slice,
-			ReplyType: int64(RE_HASH),
-		})
-	case RE_LIST:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      slice,
-			ReplyType: int64(RE_LIST),
-		})
+		addReply(c, mapValue(bulkValues(slice)...))
+	case RE_LIST, RE_ZSET:
+		addReply(c, arrayValue(bulkValues(slice)...))
 	case RE_SET:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      slice,
-			ReplyType: int64(RE_SET),
-		})
-	case RE_ZSET:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      slice,
-			ReplyType: int64(RE_ZSET),
-		})
-	case RE_FLOAT:
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      []string{*s},
-			ReplyType: int64(RE_FLOAT),
-		})
+		addReply(c, setValue(bulkValues(slice)...))
+	}
+}
+
+// arityOk reports whether argc arguments, not counting the command name,
+// fit the arity of the command.
+func arityOk(cmd GodisCommand, argc int) bool {
+	if cmd.arity_more {
+		return argc >= cmd.arity-1
 	}
+	return argc == cmd.arity-1
+}
+
+// getKeysFromCommand returns the keys among the arguments of the command,
+// args doesn't hold the command name.
+func getKeysFromCommand(cmd GodisCommand, args []string) []string {
+	if cmd.firstkey == 0 {
+		return nil
+	}
+	last := cmd.lastkey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	keys := []string{}
+	for i := cmd.firstkey; i <= last && i <= len(args); i += cmd.keystep {
+		keys = append(keys, args[i-1])
+	}
+	return keys
 }
 
 func checkArgsCount(c *GodisClient) error {
-	more := CommandTable[c.command].arity_more
-	arity := CommandTable[c.command].arity
-	if (!more && c.arg_count != (arity-1)) || (more && c.arg_count < (arity-1)) {
+	if !arityOk(CommandTable[c.command], c.arg_count) {
 		s := fmt.Sprintf("ERR wrong number of arguments for '%s' command", c.command)
 		genReply(c, RE_ERR, &s, 0, nil)
 		return errors.New("Args Count Err")
@@ -161,6 +176,104 @@ func pingCommand(c *GodisClient) {
 	genReply(c, RE_OK, &str_pong, 0, nil)
 }
 
+// checkPassword authenticates the client against requirepass, only the
+// "default" user exists.
+func checkPassword(c *GodisClient, user string, pass string) bool {
+	if user != "default" || pass != server.requirepass {
+		genReply(c, RE_ERR, &str_err_wrongpass, 0, nil)
+		return false
+	}
+	c.authenticated = true
+	return true
+}
+
+func authCommand(c *GodisClient) {
+	if err := checkArgsCount(c); err != nil {
+		return
+	}
+	if c.arg_count > 2 {
+		genReply(c, RE_ERR, &str_err_syntax, 0, nil)
+		return
+	}
+	if server.requirepass == "" {
+		genReply(c, RE_ERR, &str_err_nopass, 0, nil)
+		return
+	}
+	user, pass := "default", c.args[0]
+	if c.arg_count == 2 {
+		user, pass = c.args[0], c.args[1]
+	}
+	if checkPassword(c, user, pass) {
+		genReply(c, RE_OK, &str_ok, 0, nil)
+	}
+}
+
+// helloCommand implements HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(c *GodisClient) {
+	if err := checkArgsCount(c); err != nil {
+		return
+	}
+	ver := c.resp
+	if c.arg_count > 0 {
+		v, err := strconv.Atoi(c.args[0])
+		if err != nil {
+			s := "ERR Protocol version is not an integer or out of range"
+			genReply(c, RE_ERR, &s, 0, nil)
+			return
+		}
+		if v < 2 || v > 3 {
+			genReply(c, RE_ERR, &str_err_noproto, 0, nil)
+			return
+		}
+		ver = v
+	}
+	var user, pass, name string
+	auth, setname := false, false
+	for i := 1; i < c.arg_count; i++ {
+		more := c.arg_count - i - 1
+		switch opt := strings.ToLower(c.args[i]); {
+		case opt == "auth" && more >= 2:
+			auth = true
+			user, pass = c.args[i+1], c.args[i+2]
+			i += 2
+		case opt == "setname" && more >= 1:
+			setname = true
+			name = c.args[i+1]
+			i++
+		default:
+			s := fmt.Sprintf("ERR Syntax error in HELLO option '%s'", c.args[i])
+			genReply(c, RE_ERR, &s, 0, nil)
+			return
+		}
+	}
+	if auth {
+		if !checkPassword(c, user, pass) {
+			return
+		}
+	} else if server.requirepass != "" && !c.authenticated {
+		s := "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"
+		genReply(c, RE_ERR, &s, 0, nil)
+		return
+	}
+	if setname {
+		if strings.ContainsAny(name, " \n") {
+			s := "ERR Client names cannot contain spaces, newlines or special characters."
+			genReply(c, RE_ERR, &s, 0, nil)
+			return
+		}
+		c.name = name
+	}
+	c.resp = ver
+	addReply(c, mapValue(
+		bulkValue("server"), bulkValue("godis"),
+		bulkValue("version"), bulkValue(GODIS_VERSION),
+		bulkValue("proto"), integerValue(int64(c.resp)),
+		bulkValue("id"), integerValue(int64(c.fd)),
+		bulkValue("mode"), bulkValue("standalone"),
+		bulkValue("role"), bulkValue("master"),
+	))
+}
+
 func getCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
@@ -236,6 +349,7 @@ func hsetCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	// checkArgs do not check "mod 2"
 	if c.arg_count%2 != 1 {
 		s := fmt.Sprintf("ERR wrong number of arguments for '%s' command", c.command)
@@ -324,6 +438,7 @@ func hdelCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	var count int = 0
 	if _, ok := c.db.dict[c.args[0]]; ok {
 		if hashVal, ok := c.db.dict[c.args[0]].val.(GodisHash); ok {
@@ -362,29 +477,23 @@ func hgetallCommand(c *GodisClient) {
 		return
 	}
 	checkDel(c, c.args[0])
-	if _, ok := c.db.dict[c.args[0]]; ok {
-		if hashVal, ok := c.db.dict[c.args[0]].val.(GodisHash); ok {
-			tmp_slice := []string{}
-			for k, v := range hashVal {
-				tmp_slice = append(tmp_slice, k)
-				if strVal, ok := v.val.(string); ok {
-					tmp_slice = append(tmp_slice, strVal)
-				} else {
-					log.Printf("command %s error\n", c.command)
-				}
-			}
-			genReply(c, RE_HASH, nil, 0, tmp_slice)
-		} else {
-			genReply(c, RE_ERR, &str_err_wrongtype, 0, nil)
-			return
-		}
+	obj, ok := c.db.dict[c.args[0]]
+	if !ok {
+		genReply(c, RE_HASH, nil, 0, []string{})
+		return
+	}
+	if obj.obj_type != GODIS_HASH {
+		genReply(c, RE_ERR, &str_err_wrongtype, 0, nil)
+		return
 	}
+	addReplyStream(c, hashStream(obj))
 }
 
 func lpushCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	checkDel(c, c.args[0])
 	length := 0
 	if _, ok := c.db.dict[c.args[0]]; !ok {
@@ -407,6 +516,7 @@ func rpushCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	checkDel(c, c.args[0])
 	length := 0
 	if _, ok := c.db.dict[c.args[0]]; !ok {
@@ -428,6 +538,7 @@ func lpopCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	checkDel(c, c.args[0])
 	if _, ok := c.db.dict[c.args[0]]; !ok {
 		genReply(c, RE_NONE, nil, 0, nil)
@@ -454,6 +565,7 @@ func rpopCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	checkDel(c, c.args[0])
 	if _, ok := c.db.dict[c.args[0]]; !ok {
 		genReply(c, RE_NONE, nil, 0, nil)
@@ -526,6 +638,7 @@ func lsetCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	checkDel(c, c.args[0])
 	if _, ok := c.db.dict[c.args[0]]; !ok {
 		genReply(c, RE_ERR, &str_err_nokey, 0, nil)
@@ -579,19 +692,7 @@ func lrangeCommand(c *GodisClient) {
 			genReply(c, RE_LIST, nil, 0, []string{})
 			return
 		}
-		tmp := []string{}
-		node := listVal.listGetIndex(int64(start))
-		for start <= stop {
-
-			if strVal, ok := node.val.val.(string); ok {
-				tmp = append(tmp, strVal)
-			} else {
-				log.Printf("command %s error\n", c.command)
-			}
-			node = node.next
-			start++
-		}
-		genReply(c, RE_LIST, nil, 0, tmp)
+		addReplyStream(c, listStream(c.db.dict[c.args[0]], start, stop))
 	} else {
 		genReply(c, RE_ERR, &str_err_wrongtype, 0, nil)
 		return
@@ -602,6 +703,7 @@ func saddCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 
 	if _, ok := c.db.dict[c.args[0]]; !ok {
 		c.db.dict[c.args[0]] = CreateObj(GODIS_SET, nil)
@@ -681,31 +783,23 @@ func sinterCommand(c *GodisClient) {
 		return
 	}
 	checkDel(c, c.args[0])
-	if _, ok := c.db.dict[c.args[0]]; !ok {
+	obj, ok := c.db.dict[c.args[0]]
+	if !ok {
 		genReply(c, RE_SET, nil, 0, []string{})
-	} else {
-		if c.db.dict[c.args[0]].obj_type != GODIS_SET {
-			genReply(c, RE_ERR, &str_err_wrongtype, 0, nil)
-			return
-		}
+		return
 	}
-
-	if setVal, ok := c.db.dict[c.args[0]].val.(GodisSet); ok {
-		tmp := []string{}
-		for k := range setVal {
-			tmp = append(tmp, k)
-		}
-		genReply(c, RE_SET, nil, 0, tmp)
-	} else {
-		log.Printf("command %s error\n", c.command)
+	if obj.obj_type != GODIS_SET {
+		genReply(c, RE_ERR, &str_err_wrongtype, 0, nil)
 		return
 	}
+	addReplyStream(c, setStream(obj))
 }
 
 func sremCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	checkDel(c, c.args[0])
 	if _, ok := c.db.dict[c.args[0]]; !ok {
 		genReply(c, RE_INT, nil, 0, nil)
@@ -734,6 +828,7 @@ func zaddCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	if c.arg_count%2 != 1 {
 		s := fmt.Sprintf("ERR wrong number of arguments for '%s' command", c.command)
 		genReply(c, RE_ERR, &s, 0, nil)
@@ -827,13 +922,24 @@ func zcountCommand(c *GodisClient) {
 	}
 }
 
+// zrangeCommand implements ZRANGE key min max [WITHSCORES], min and max are
+// scores. WITHSCORES replies with [member, score] pairs, or with members and
+// scores side by side to RESP2 clients.
 func zrangeCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	withscores := false
+	if c.arg_count == 4 && strings.ToLower(c.args[3]) == "withscores" {
+		withscores = true
+	} else if c.arg_count > 3 {
+		genReply(c, RE_ERR, &str_err_syntax, 0, nil)
+		return
+	}
 	checkDel(c, c.args[0])
 	if _, ok := c.db.dict[c.args[0]]; !ok {
 		genReply(c, RE_INT, nil, 0, nil)
+		return
 	} else {
 		if c.db.dict[c.args[0]].obj_type != GODIS_ZSET {
 			genReply(c, RE_ERR, &str_err_wrongtype, 0, nil)
@@ -851,17 +957,25 @@ func zrangeCommand(c *GodisClient) {
 			genReply(c, RE_ERR, &str_err_notfloat, 0, nil)
 			return
 		}
+		flat := c.proto == PROTO_RESP && c.resp == 2
 		node := zsetVal.zskiplist.spFirstInRange(start, stop)
-		tmp := []string{}
+		tmp := []*myProto.Value{}
 		for node != nil && node.score <= stop {
 			if strVal, ok := node.obj.val.(string); ok {
-				tmp = append(tmp, strVal)
+				switch {
+				case !withscores:
+					tmp = append(tmp, bulkValue(strVal))
+				case flat:
+					tmp = append(tmp, bulkValue(strVal), bulkValue(formatDouble(node.score)))
+				default:
+					tmp = append(tmp, arrayValue(bulkValue(strVal), doubleValue(node.score)))
+				}
 			} else {
 				log.Printf("command %s error\n", c.command)
 			}
 			node = zsetVal.zskiplist.spNext(node)
 		}
-		genReply(c, RE_ZSET, nil, 0, tmp)
+		addReply(c, arrayValue(tmp...))
 	} else {
 		log.Printf("command %s error\n", c.command)
 		return
@@ -904,6 +1018,7 @@ func zremCommand(c *GodisClient) {
 	if err := checkArgsCount(c); err != nil {
 		return
 	}
+	unshareObject(c.db, c.args[0])
 	checkDel(c, c.args[0])
 	if _, ok := c.db.dict[c.args[0]]; !ok {
 		genReply(c, RE_INT, nil, 0, nil)
@@ -950,9 +1065,7 @@ func zscoreCommand(c *GodisClient) {
 			return
 		}
 
-		s := fmt.Sprintf("%.2f", score)
-
-		genReply(c, RE_FLOAT, &s, 0, nil)
+		addReply(c, doubleValue(score))
 	} else {
 		log.Printf("command %s error\n", c.command)
 		return
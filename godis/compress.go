@@ -0,0 +1,130 @@
+package godis
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	myProto "godisdb/proto"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// COMPRESSION_FLATE is the name of the compress/flate codec, the only one
+// a client can negotiate with the compression field of a Cmd.
+const COMPRESSION_FLATE string = "flate"
+
+// COMPRESSION_THRESHOLD_DEFAULT is the size in bytes from which frames are
+// compressed, smaller ones rarely get any smaller.
+const COMPRESSION_THRESHOLD_DEFAULT int = 1024
+
+// COMPRESSION_MAX_INFLATED_LEN bounds the size a compressed frame expands to,
+// so a small frame can't make the server allocate without limit.
+const COMPRESSION_MAX_INFLATED_LEN int = 512 * 1024 * 1024
+
+// errInflateLimit is returned by Inflate for data expanding over the limit.
+var errInflateLimit = errors.New("compressed frame expands over the limit")
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// Deflate compresses data with the flate codec.
+func Deflate(data []byte) []byte {
+	var b bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+// Inflate decompresses data compressed with the flate codec, failing when it
+// expands to more than limit bytes.
+func Inflate(data []byte, limit int) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("%w of %d bytes", errInflateLimit, limit)
+	}
+	return out, nil
+}
+
+// decompressCmd replaces a compressed command with the command it holds. The
+// command may expand no further than the query buffer limit, the frame it
+// came in was checked against.
+func decompressCmd(cmd *myProto.Cmd) error {
+	if len(cmd.Compressed) == 0 {
+		return nil
+	}
+	compressed := len(cmd.Compressed)
+	raw, err := Inflate(cmd.Compressed, min(server.client_max_querybuf_len, COMPRESSION_MAX_INFLATED_LEN))
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(raw, cmd); err != nil {
+		return err
+	}
+	atomic.AddInt64(&server.stat_compressed_frames_in, 1)
+	atomic.AddInt64(&server.stat_compression_saved_in, int64(len(raw)-compressed))
+	return nil
+}
+
+// negotiateCompression enables the codec asked by the client, unknown codecs
+// leave compression off and aren't acked so the client doesn't use them.
+func negotiateCompression(c *GodisClient, codec string) {
+	if codec == "" {
+		return
+	}
+	if codec != COMPRESSION_FLATE {
+		log.Printf("Client %s asked for unsupported compression %q\n", c.addr, codec)
+		c.compression = ""
+		return
+	}
+	c.compression = codec
+}
+
+// compressReply acks the codec negotiated by the client and, when the reply
+// is over the threshold, replaces it with its compressed form. Replies that
+// don't get smaller are sent as they are.
+func compressReply(c *GodisClient, reply *myProto.Reply) *myProto.Reply {
+	reply.Compression = c.compression
+	size := proto.Size(reply)
+	if size < server.compression_threshold {
+		return reply
+	}
+	raw, err := proto.MarshalOptions{UseCachedSize: true}.Marshal(reply)
+	if err != nil {
+		return reply
+	}
+	compressed := Deflate(raw)
+	if len(compressed) >= size {
+		return reply
+	}
+	atomic.AddInt64(&server.stat_compressed_frames_out, 1)
+	atomic.AddInt64(&server.stat_compression_saved_out, int64(size-len(compressed)))
+	return &myProto.Reply{
+		Version:     reply.Version,
+		Compression: c.compression,
+		Compressed:  compressed,
+	}
+}
@@ -0,0 +1,136 @@
+package godis
+
+import (
+	"bufio"
+	myProto "godisdb/proto"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func appendFrame(buf []byte, cmd *myProto.Cmd) []byte {
+	frame, _ := proto.Marshal(cmd)
+	buf = protowire.AppendVarint(buf, uint64(len(frame)))
+	return append(buf, frame...)
+}
+
+// readCompressedReply reads a reply the way a client that negotiated
+// compression does, returns it and whether it came compressed.
+func readCompressedReply(t *testing.T, r *bufio.Reader) (*myProto.Reply, bool) {
+	var reply myProto.Reply
+	err := protodelim.UnmarshalOptions{MaxSize: -1}.UnmarshalFrom(r, &reply)
+	if err != nil {
+		t.Fatalf("UnmarshalFrom() returned an error: %v", err)
+	}
+	if len(reply.Compressed) == 0 {
+		return &reply, false
+	}
+	raw, err := Inflate(reply.Compressed, COMPRESSION_MAX_INFLATED_LEN)
+	if err != nil {
+		t.Fatalf("Inflate() returned an error: %v", err)
+	}
+	if err := proto.Unmarshal(raw, &reply); err != nil {
+		t.Fatalf("Unmarshal() of the compressed reply returned an error: %v", err)
+	}
+	return &reply, true
+}
+
+func TestCompression(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	big := strings.Repeat("compressible ", 1000)
+	conn.Write(appendFrame(nil, &myProto.Cmd{
+		Command:     []byte("set"),
+		Args:        stringsToBytes([]string{"k", big}),
+		Version:     PROTOBUF_VERSION,
+		Compression: COMPRESSION_FLATE,
+	}))
+	reply, compressed := readCompressedReply(t, r)
+	if reply.Compression != COMPRESSION_FLATE || compressed || reply.Value.GetStatus() != "OK" {
+		t.Fatalf("set returned %v, compressed %v", reply, compressed)
+	}
+
+	conn.Write(appendCmd(nil, "get", "k"))
+	reply, compressed = readCompressedReply(t, r)
+	if !compressed || string(reply.Value.GetBulk()) != big {
+		t.Fatalf("get returned a reply compressed %v with a value of %d bytes", compressed, len(reply.Value.GetBulk()))
+	}
+
+	raw, _ := proto.Marshal(&myProto.Cmd{
+		Command: []byte("hset"),
+		Args:    stringsToBytes([]string{"h", "f", big}),
+		Version: PROTOBUF_VERSION,
+	})
+	conn.Write(appendFrame(nil, &myProto.Cmd{Compressed: Deflate(raw)}))
+	reply, _ = readCompressedReply(t, r)
+	if reply.Value.GetInteger() != 1 {
+		t.Fatalf("a compressed hset returned %v", reply.Value)
+	}
+
+	conn.Write(appendCmd(nil, "info", "stats"))
+	reply, _ = readCompressedReply(t, r)
+	info := string(reply.Value.GetBulk())
+	for _, field := range []string{"compressed_frames_received:1\r\n", "compressed_frames_sent:1\r\n"} {
+		if !strings.Contains(info, field) {
+			t.Fatalf("INFO stats doesn't contain %q:\n%s", field, info)
+		}
+	}
+	for _, field := range []string{"compression_saved_input_bytes:", "compression_saved_output_bytes:"} {
+		if strings.Contains(info, field+"0\r\n") {
+			t.Fatalf("INFO stats reports no %s saved:\n%s", field, info)
+		}
+	}
+
+	// codecs the server doesn't know aren't acked
+	other := dialTestServer(t)
+	other.SetDeadline(time.Now().Add(5 * time.Second))
+	or := bufio.NewReader(other)
+	other.Write(appendFrame(nil, &myProto.Cmd{
+		Command:     []byte("get"),
+		Args:        stringsToBytes([]string{"k"}),
+		Version:     PROTOBUF_VERSION,
+		Compression: "lz77",
+	}))
+	reply, compressed = readCompressedReply(t, or)
+	if reply.Compression != "" || compressed {
+		t.Fatalf("an unsupported codec got a reply with compression %q, compressed %v", reply.Compression, compressed)
+	}
+}
+
+// TestCompressedFrameLimit sends a small frame inflating over the query
+// buffer limit, it is rejected like a frame that large would be.
+func TestCompressedFrameLimit(t *testing.T) {
+	startTestServer(t, func() {
+		server.client_max_querybuf_len = 64 * 1024
+	})
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	raw, _ := proto.Marshal(&myProto.Cmd{
+		Command: []byte("set"),
+		Args:    stringsToBytes([]string{"k", strings.Repeat("v", 1024*1024)}),
+		Version: PROTOBUF_VERSION,
+	})
+	// the ping sets the protocol version the error is replied in
+	conn.Write(appendFrame(appendCmd(nil, "ping"), &myProto.Cmd{Compressed: Deflate(raw)}))
+	readReply(t, r)
+	if reply := readReply(t, r); reply.GetError() != "ERR Protocol error: compressed frame over the query buffer limit" {
+		t.Fatalf("a frame inflating to 1MB returned %v", reply)
+	}
+	expectClosed(t, r)
+
+	conn = dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(appendCmd(nil, "info", "stats"))
+	if info := string(readReply(t, bufio.NewReader(conn)).GetBulk()); !strings.Contains(info, "rejected_requests:1\r\n") {
+		t.Fatalf("INFO stats doesn't count the rejected request:\n%s", info)
+	}
+}
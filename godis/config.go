@@ -0,0 +1,211 @@
+package godis
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadServerConfig applies a config file to the server.
+func loadServerConfig(filename string) error {
+	return loadConfigFile(server, filename)
+}
+
+// loadConfigFile reads a config file made of "directive arg ..." lines into
+// config, blank lines and lines starting with '#' are ignored.
+func loadConfigFile(config *GodisServer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	linenum := 0
+	for scanner.Scan() {
+		linenum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		argv := strings.Fields(line)
+		err = loadConfigArgs(config, strings.ToLower(argv[0]), argv[1:])
+		if err != nil {
+			return fmt.Errorf("config file %s line %d: '%s': %v", filename, linenum, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func loadConfigArgs(config *GodisServer, name string, args []string) error {
+	var err error
+	switch {
+	case name == "bind" && len(args) >= 1:
+		config.bindaddr = args
+	case name == "port" && len(args) == 1:
+		config.port, err = parsePort(args[0])
+	case name == "resp-port" && len(args) == 1:
+		config.resp_port, err = parsePort(args[0])
+	case name == "http-port" && len(args) == 1:
+		config.http_port, err = parsePort(args[0])
+	case name == "tls-port" && len(args) == 1:
+		config.tls_port, err = parsePort(args[0])
+	case name == "tls-cert-file" && len(args) == 1:
+		config.tls_cert_file = args[0]
+	case name == "tls-key-file" && len(args) == 1:
+		config.tls_key_file = args[0]
+	case name == "tls-ca-cert-file" && len(args) == 1:
+		config.tls_ca_cert_file = args[0]
+	case name == "tls-auth-clients" && len(args) == 1:
+		switch strings.ToLower(args[0]) {
+		case "yes":
+			config.tls_auth_clients = TLS_CLIENT_AUTH_YES
+		case "no":
+			config.tls_auth_clients = TLS_CLIENT_AUTH_NO
+		case "optional":
+			config.tls_auth_clients = TLS_CLIENT_AUTH_OPTIONAL
+		default:
+			return fmt.Errorf("argument must be 'yes', 'no' or 'optional'")
+		}
+	case name == "unixsocket" && len(args) == 1:
+		config.unixsocket = args[0]
+	case name == "unixsocketperm" && len(args) == 1:
+		var perm uint64
+		perm, err = strconv.ParseUint(args[0], 8, 32)
+		if err != nil || perm > 0777 {
+			return fmt.Errorf("Invalid socket file permissions")
+		}
+		config.unixsocketperm = uint32(perm)
+	case name == "client-output-buffer-limit" && len(args)%4 == 0:
+		// client-output-buffer-limit <class> <hard> <soft> <soft seconds> ...
+		for i := 0; i < len(args); i += 4 {
+			class := getClientTypeByName(args[i])
+			if class == -1 {
+				return fmt.Errorf("Invalid client class specified in buffer limit configuration.")
+			}
+			hard, err1 := memtoll(args[i+1])
+			soft, err2 := memtoll(args[i+2])
+			seconds, err3 := strconv.Atoi(args[i+3])
+			if err1 != nil || err2 != nil || err3 != nil || seconds < 0 {
+				return fmt.Errorf("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+			}
+			config.client_obuf_limits[class] = ClientBufferLimit{hard, soft, seconds}
+		}
+	case name == "maxclients" && len(args) == 1:
+		config.maxclients, err = strconv.Atoi(args[0])
+		if err != nil || config.maxclients < 1 {
+			return fmt.Errorf("Invalid max clients limit")
+		}
+	case name == "timeout" && len(args) == 1:
+		config.maxidletime, err = strconv.Atoi(args[0])
+		if err != nil || config.maxidletime < 0 {
+			return fmt.Errorf("Invalid timeout value")
+		}
+	case name == "tcp-keepalive" && len(args) == 1:
+		config.tcpkeepalive, err = strconv.Atoi(args[0])
+		if err != nil || config.tcpkeepalive < 0 {
+			return fmt.Errorf("Invalid tcp-keepalive value")
+		}
+	case name == "compression-threshold" && len(args) == 1:
+		config.compression_threshold, err = memtoll(args[0])
+		if err != nil || config.compression_threshold < 0 {
+			return fmt.Errorf("Invalid compression-threshold value")
+		}
+	case name == "io-threads" && len(args) == 1:
+		config.io_threads_num, err = strconv.Atoi(args[0])
+		if err != nil || config.io_threads_num < 1 || config.io_threads_num > IO_THREADS_MAX_NUM {
+			return fmt.Errorf("Invalid number of I/O threads")
+		}
+	case name == "client-query-buffer-limit" && len(args) == 1:
+		config.client_max_querybuf_len, err = memtoll(args[0])
+		if err != nil || config.client_max_querybuf_len <= 0 {
+			return fmt.Errorf("Invalid client query buffer limit")
+		}
+	case name == "proto-max-bulk-len" && len(args) == 1:
+		config.proto_max_bulk_len, err = memtoll(args[0])
+		if err != nil || config.proto_max_bulk_len <= 0 {
+			return fmt.Errorf("Invalid proto max bulk len")
+		}
+	case name == "proto-max-args" && len(args) == 1:
+		config.proto_max_args, err = strconv.Atoi(args[0])
+		if err != nil || config.proto_max_args < 2 {
+			return fmt.Errorf("Invalid proto max args")
+		}
+	case name == "reply-chunk-size" && len(args) == 1:
+		config.reply_chunk_len, err = strconv.Atoi(args[0])
+		if err != nil || config.reply_chunk_len < 0 {
+			return fmt.Errorf("Invalid reply chunk size")
+		}
+	case name == "shards" && len(args) == 1:
+		config.shards_num, err = strconv.Atoi(args[0])
+		if err != nil || config.shards_num < 1 || config.shards_num > SHARDS_MAX_NUM {
+			return fmt.Errorf("Invalid number of shards")
+		}
+	case name == "poller" && len(args) == 1:
+		config.poller = strings.ToLower(args[0])
+		if config.poller != AE_POLLER_EPOLL && config.poller != AE_POLLER_POLL {
+			return fmt.Errorf("argument must be 'epoll' or 'poll'")
+		}
+	case name == "logfile" && len(args) == 1:
+		// logfile "" logs to stderr
+		config.logfile = strings.Trim(args[0], "\"")
+	case name == "shutdown-timeout" && len(args) == 1:
+		config.shutdown_timeout, err = strconv.Atoi(args[0])
+		if err != nil || config.shutdown_timeout < 0 {
+			return fmt.Errorf("Invalid shutdown timeout")
+		}
+	case name == "io-threads-do-reads" && len(args) == 1:
+		yes := yesnotoi(args[0])
+		if yes == -1 {
+			return fmt.Errorf("argument must be 'yes' or 'no'")
+		}
+		config.io_threads_do_reads = yes == 1
+	case name == "requirepass" && len(args) == 1:
+		config.requirepass = args[0]
+	default:
+		return fmt.Errorf("Bad directive or wrong number of arguments")
+	}
+	return err
+}
+
+// memtoll parses a memory amount such as 100, 1k, 64mb or 1gb.
+func memtoll(s string) (int, error) {
+	s = strings.ToLower(s)
+	mul := 1
+	for _, unit := range []struct {
+		suffix string
+		mul    int
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			mul = unit.mul
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid memory amount")
+	}
+	return n * mul, nil
+}
+
+// yesnotoi returns 1 for yes, 0 for no and -1 for anything else.
+func yesnotoi(s string) int {
+	switch strings.ToLower(s) {
+	case "yes":
+		return 1
+	case "no":
+		return 0
+	}
+	return -1
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("Invalid port")
+	}
+	return port, nil
+}
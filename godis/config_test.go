@@ -0,0 +1,43 @@
+package godis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadServerConfig(t *testing.T) {
+	initServerConfig()
+	path := filepath.Join(t.TempDir(), "godis.conf")
+	os.WriteFile(path, []byte("# comment\n\nport 7000\nunixsocket /tmp/godis.sock\nunixsocketperm 755\ntimeout 60\ntcp-keepalive 0\nio-threads 4\nio-threads-do-reads no\nshards 4\npoller poll\nlogfile /tmp/godis.log\nshutdown-timeout 30\n"+
+		"client-query-buffer-limit 1mb\nproto-max-bulk-len 2mb\nproto-max-args 100\n"), 0600)
+	if err := loadServerConfig(path); err != nil {
+		t.Fatalf("loadServerConfig() returned an error: %v", err)
+	}
+	if server.port != 7000 || server.unixsocket != "/tmp/godis.sock" || server.unixsocketperm != 0755 ||
+		server.maxidletime != 60 || server.tcpkeepalive != 0 || server.io_threads_num != 4 || server.io_threads_do_reads ||
+		server.shards_num != 4 || server.client_max_querybuf_len != 1<<20 || server.proto_max_bulk_len != 2<<20 ||
+		server.proto_max_args != 100 || server.poller != AE_POLLER_POLL ||
+		server.logfile != "/tmp/godis.log" || server.shutdown_timeout != 30 {
+		t.Errorf("loadServerConfig() did not apply the settings: %+v", server)
+	}
+
+	os.WriteFile(path, []byte("io-threads 0\n"), 0600)
+	if err := loadServerConfig(path); err == nil {
+		t.Error("loadServerConfig() accepted io-threads 0")
+	}
+	os.WriteFile(path, []byte("shards 0\n"), 0600)
+	if err := loadServerConfig(path); err == nil {
+		t.Error("loadServerConfig() accepted shards 0")
+	}
+
+	os.WriteFile(path, []byte("poller select\n"), 0600)
+	if err := loadServerConfig(path); err == nil {
+		t.Error("loadServerConfig() accepted poller select")
+	}
+
+	os.WriteFile(path, []byte("port 7000\nnosuchdirective yes\n"), 0600)
+	if err := loadServerConfig(path); err == nil {
+		t.Error("loadServerConfig() accepted an unknown directive")
+	}
+}
@@ -1,45 +1,188 @@
 package godis
 
 import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	myProto "godisdb/proto"
+	"io"
 	"log"
 	"math/rand"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
+const IOBUF_LEN int = 16 * 1024
+
+const MAXCLIENTS_DEFAULT int = 10000
+
+const (
+	CLIENT_MAX_QUERYBUF_LEN_DEFAULT int = 1024 * 1024 * 1024
+	PROTO_MAX_BULK_LEN_DEFAULT      int = 512 * 1024 * 1024
+	PROTO_MAX_ARGS_DEFAULT          int = 1024 * 1024
+	// longest frame of a client that didn't authenticate yet, when a
+	// password is required
+	PROTO_UNAUTH_MAX_FRAME_LEN int = 16 * 1024
+)
+
+// MIN_RESERVED_FDS is the number of fds each shard keeps for its listeners,
+// its epoll fd and the log out of the open files limit.
+const MIN_RESERVED_FDS int = 32
+
 type GodisDB struct {
 	dict    map[string]*GodisObj
 	expires map[string]int
 }
 
+type ClientProto int
+
+const (
+	PROTO_PROTOBUF ClientProto = 1
+	PROTO_RESP     ClientProto = 2
+	PROTO_HTTP     ClientProto = 3
+)
+
+const GODIS_VERSION string = "0.1.0"
+
+// PROTOBUF_VERSION is the version of the protobuf protocol. Version 1 made
+// command and reply arguments bytes instead of UTF-8 strings, version 2
+// replaced the flat reply args with a nested value, version 3 streams large
+// collections as several replies flagged with more.
+const PROTOBUF_VERSION uint32 = 3
+
+type ClientType int
+
+// replication is not implemented, the replica class only exists so that the
+// client-output-buffer-limit setting accepts the same classes as Redis
+const (
+	CLIENT_TYPE_NORMAL  ClientType = 0
+	CLIENT_TYPE_REPLICA ClientType = 1
+	CLIENT_TYPE_PUBSUB  ClientType = 2
+	CLIENT_TYPE_COUNT   int        = 3
+)
+
+var clientTypeNames = [CLIENT_TYPE_COUNT]string{"normal", "replica", "pubsub"}
+
+type ClientBufferLimit struct {
+	hard_limit_bytes   int
+	soft_limit_bytes   int
+	soft_limit_seconds int
+}
+
 type GodisClient struct {
-	fd               int
-	db               *GodisDB
-	db_id            int
-	name             string
-	arg_count        int
-	command          string
-	args             []string
-	reply            []myProto.Reply
-	ctime            int
-	last_interaction int
-	read_buf         [1024]byte
+	fd              int
+	shard           *GodisShard // the shard whose loop serves the connection
+	proto           ClientProto
+	resp            int // RESP version negotiated with HELLO
+	tls             *GodisTlsConn
+	authenticated   bool
+	pubsub_channels map[string]bool
+	db              *GodisDB
+	db_id           int
+	name            string
+	arg_count       int
+	command         string
+	args            []string
+	buf             []byte // serialized replies waiting to be written
+	sentlen         int    // how much of buf has been written already
+	addr            string
+	close_asap      bool // freed by serverCron, no more replies are queued
+	// freed once the output buffer is sent, no more requests are read
+	close_after_reply bool
+	ctime             int
+	// ms time the output buffer went over the soft limit, 0 if it is under it
+	obuf_soft_limit_reached_time int
+	last_interaction             int
+	query_buf                    []byte
+	batch_replies                []*myProto.Value // replies collected while running a batch, nil otherwise
+	proto_version                uint32           // protobuf protocol version announced by the client
+	compression                  string           // codec negotiated for replies, "" when they aren't compressed
+	pending_cmds                 []*myProto.Cmd   // commands decoded from the query buffer and not run yet
+	pending_values               []*myProto.Value // replies left for an IO thread to serialize
+	pending_values_len           int              // size of pending_values once serialized, estimated
+	pending_read                 bool             // queued in clients_pending_read
+	pending_write                bool             // queued in clients_pending_write
+	io_err                       error            // read or write error met by an IO thread
+	proto_err                    string           // protocol error met parsing the query buffer, replied after the commands before it
+	blocked                      bool             // waiting for a forwarded command or a streamed reply, its input waits
+	stream                       *replyStream     // the reply being streamed, nil if none
+	deferred_replies             []*myProto.Value // messages published while a reply was streamed
+	frame_len                    int              // length of the pending frame, -1 if its header is not parsed yet
+	resp_parser                  respParser       // state of the RESP request being read
+	http_close                   bool             // the HTTP request being served asked for Connection: close
+	http_continued               bool             // 100 Continue was sent for the HTTP request being read
 }
 
 type GodisServer struct {
-	fd                    int
-	ip                    string
-	port                  int
-	loop                  *AeEventLoop
-	db_count              int
-	clients               map[int]*GodisClient
-	db                    map[int]*GodisDB
-	expire_check_count    int
-	expire_check_interval int
+	bindaddr                       []string
+	port                           int
+	resp_port                      int
+	http_port                      int
+	tls_port                       int
+	tls_cert_file                  string
+	tls_key_file                   string
+	tls_ca_cert_file               string
+	tls_auth_clients               TlsAuthClients
+	tls_config                     *tls.Config
+	sofd                           int
+	unixsocket                     string
+	unixsocketperm                 uint32
+	shards                         []*GodisShard
+	shards_num                     int
+	poller                         string // I/O multiplexing backend of the event loops
+	configfile                     string // reloaded on SIGHUP
+	configured_io_threads_num      int    // io-threads as configured, io_threads_num may be lowered
+	configured_poller              string // poller as configured, poller falls back to poll without epoll
+	logfile                        string // the log goes to stderr when empty
+	log_file                       *os.File
+	signal_ch                      chan os.Signal
+	shutdown_asap                  bool  // a graceful shutdown is in progress
+	shutdown_timeout               int   // seconds a shutdown waits for the replies to be written
+	shards_draining                int64 // shards with clients waiting for replies during a shutdown
+	db_count                       int
+	connected_clients              int64 // clients of every shard, updated atomically
+	requirepass                    string
+	maxclients                     int
+	maxidletime                    int // close clients idle for more seconds, 0 disables it
+	tcpkeepalive                   int // SO_KEEPALIVE interval in seconds, 0 disables it
+	compression_threshold          int // replies of at least this many bytes are compressed
+	reply_chunk_len                int // elements per chunk of a streamed reply, 0 disables streaming
+	client_max_querybuf_len        int // clients buffering more unprocessed input are closed
+	proto_max_bulk_len             int // longest argument of a request
+	proto_max_args                 int // most arguments of a request, the command name included
+	io_threads_num                 int // threads doing client I/O, the main loop included
+	io_threads_do_reads            bool
+	io_threads                     []*ioThread
+	io_threads_wg                  sync.WaitGroup
+	clients_pending_read           []*GodisClient
+	clients_pending_write          []*GodisClient
+	client_obuf_limits             [CLIENT_TYPE_COUNT]ClientBufferLimit
+	stat_starttime                 int
+	stat_numconnections            int64 // updated atomically like the other stats shards share
+	stat_obuf_limit_disconnections int64
+	stat_rejected_conn             int64
+	stat_compressed_frames_in      int64 // updated atomically, IO threads decompress
+	stat_compressed_frames_out     int64
+	stat_compression_saved_in      int64 // bytes compression saved on received commands
+	stat_compression_saved_out     int64 // bytes compression saved on sent replies
+	stat_io_reads_processed        int   // clients read by IO threads
+	stat_io_writes_processed       int   // clients written by IO threads
+	stat_forwarded_commands        int64 // commands and batches forwarded to another shard
+	stat_streamed_replies          int64
+	stat_rejected_requests         int64 // requests replied with a protocol error
+	stat_qbuf_limit_disconnections int64
+	expire_check_count             int
+	expire_check_interval          int
+	hz                             int // serverCron runs hz times per second
 }
 
 type ReplyType int64
@@ -55,26 +198,148 @@ const (
 	RE_ZSET   ReplyType = 8
 	RE_FLOAT  ReplyType = 9
 	RE_NONE   ReplyType = 10
+	RE_PUSH   ReplyType = 11
 )
 
+// getClientTypeByName returns the class named by a config file, or -1.
+func getClientTypeByName(name string) ClientType {
+	switch strings.ToLower(name) {
+	case "normal":
+		return CLIENT_TYPE_NORMAL
+	case "replica", "slave":
+		return CLIENT_TYPE_REPLICA
+	case "pubsub":
+		return CLIENT_TYPE_PUBSUB
+	}
+	return -1
+}
+
+func getClientType(c *GodisClient) ClientType {
+	if len(c.pubsub_channels) > 0 {
+		return CLIENT_TYPE_PUBSUB
+	}
+	return CLIENT_TYPE_NORMAL
+}
+
+// getClientOutputBufferMemoryUsage returns the bytes queued for the client and
+// not written to the socket yet, the replies left for the IO threads
+// included.
+func getClientOutputBufferMemoryUsage(c *GodisClient) int {
+	used := len(c.buf) - c.sentlen + c.pending_values_len
+	if c.tls != nil {
+		used += len(c.tls.transport.out)
+	}
+	return used
+}
+
+// checkClientOutputBufferLimits reports whether the client went over the hard
+// limit of its class, or stayed over the soft limit for too long.
+func checkClientOutputBufferLimits(c *GodisClient) bool {
+	used := getClientOutputBufferMemoryUsage(c)
+	limit := server.client_obuf_limits[getClientType(c)]
+	hard := limit.hard_limit_bytes != 0 && used >= limit.hard_limit_bytes
+	soft := limit.soft_limit_bytes != 0 && used >= limit.soft_limit_bytes
+	if soft {
+		now := GetMsTime()
+		if c.obuf_soft_limit_reached_time == 0 {
+			c.obuf_soft_limit_reached_time = now
+			soft = false
+		} else if now-c.obuf_soft_limit_reached_time <= limit.soft_limit_seconds*1000 {
+			soft = false
+		}
+	} else {
+		c.obuf_soft_limit_reached_time = 0
+	}
+	return hard || soft
+}
+
+func closeClientOnOutputBufferLimitReached(c *GodisClient) {
+	if c.close_asap || !checkClientOutputBufferLimits(c) {
+		return
+	}
+	log.Printf("Client %s scheduled to be closed ASAP for overcoming of output buffer limits.\n", c.addr)
+	atomic.AddInt64(&server.stat_obuf_limit_disconnections, 1)
+	freeClientAsync(c)
+}
+
+// freeClientAsync schedules the client to be freed by serverCron, for when
+// it can't be freed right away because a command is still using it.
+func freeClientAsync(c *GodisClient) {
+	if c.close_asap {
+		return
+	}
+	c.close_asap = true
+	c.shard.clients_to_close = append(c.shard.clients_to_close, c)
+}
+
+func freeClientsInAsyncFreeQueue(s *GodisShard) {
+	for _, c := range s.clients_to_close {
+		freeClient(c)
+	}
+	s.clients_to_close = s.clients_to_close[:0]
+}
+
+// clientsCronHandleTimeout frees the client if it has been idle for more
+// than maxidletime seconds, returns true if the client was freed. Subscribed
+// clients are exempt since they wait for messages without sending anything,
+// and so are clients waiting for a command forwarded to another shard.
+func clientsCronHandleTimeout(c *GodisClient, now int) bool {
+	if server.maxidletime == 0 || len(c.pubsub_channels) > 0 || c.blocked {
+		return false
+	}
+	if now-c.last_interaction <= server.maxidletime*1000 {
+		return false
+	}
+	log.Printf("Closing idle client %s\n", c.addr)
+	freeClient(c)
+	return true
+}
+
+// clientsCron runs the periodic checks on every client of the shard.
+func clientsCron(s *GodisShard) {
+	now := GetMsTime()
+	for _, c := range s.clients {
+		if clientsCronHandleTimeout(c, now) {
+			continue
+		}
+		closeClientOnOutputBufferLimitReached(c)
+	}
+}
+
+func serverCron(loop *AeEventLoop, fd int, extra interface{}) int {
+	s := shardOf(loop)
+	clientsCron(s)
+	freeClientsInAsyncFreeQueue(s)
+	return 1000 / server.hz
+}
+
+// beforeSleep runs every time the event loop is about to wait for events,
+// the replies queued for the IO threads are written before it does.
+func beforeSleep(loop *AeEventLoop) {
+	handleClientsWithPendingReadsUsingThreads()
+	handleClientsWithPendingWritesUsingThreads()
+	freeClientsInAsyncFreeQueue(shardOf(loop))
+}
+
 func findExpiredKey(loop *AeEventLoop, fd int, extra interface{}) int {
+	db := shardOf(loop).db
 	for i := 0; i < server.db_count; i++ {
 		now := GetMsTime()
-		if len(server.db[i].expires) == 0 {
+		if len(db[i].expires) == 0 {
 			return server.expire_check_interval
 		}
-		keys := make([]string, 0, len(server.db[i].expires))
-		for k := range server.db[i].expires {
+		keys := make([]string, 0, len(db[i].expires))
+		for k := range db[i].expires {
 			keys = append(keys, k)
 		}
 		r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 		for j := 0; j < server.expire_check_count; j++ {
 			randomKey := keys[r.Intn(len(keys))]
-			v, ok := server.db[i].expires[randomKey]
+			v, ok := db[i].expires[randomKey]
 			if ok && v < now {
-				delete(server.db[i].expires, randomKey)
-				delete(server.db[i].dict, randomKey)
+				delete(db[i].expires, randomKey)
+				delete(db[i].dict, randomKey)
 			}
 		}
 	}
@@ -82,144 +347,850 @@ func findExpiredKey(loop *AeEventLoop, fd int, extra interface{}) int {
 	return server.expire_check_interval
 }
 
+// clientHasPendingReplies reports whether output is still waiting for the
+// socket to become writable.
+func clientHasPendingReplies(c *GodisClient) bool {
+	if c.tls != nil && len(c.tls.transport.out) > 0 {
+		return true
+	}
+	return c.sentlen < len(c.buf)
+}
+
+// addReply serializes a reply into the output buffer of the client, the
+// write handler is installed when the buffer goes from empty to non-empty.
+// With IO threads the reply is queued and serialized in beforeSleep instead.
+func addReply(c *GodisClient, v *myProto.Value) {
+	if c.close_asap {
+		return
+	}
+	if c.batch_replies != nil {
+		c.batch_replies = append(c.batch_replies, v)
+		return
+	}
+	// only published messages reach a client streaming a reply, they
+	// follow the reply
+	if c.stream != nil {
+		c.deferred_replies = append(c.deferred_replies, v)
+		return
+	}
+	if clientUsesThreadedWrites(c) {
+		c.pending_values = append(c.pending_values, v)
+		c.pending_values_len += proto.Size(v)
+		if !c.pending_write {
+			c.pending_write = true
+			server.clients_pending_write = append(server.clients_pending_write, c)
+		}
+		closeClientOnOutputBufferLimitReached(c)
+		return
+	}
+	buf, err := appendReply(c.buf, c, v)
+	if err != nil {
+		log.Printf("addReply proto error: %v\n", err)
+		return
+	}
+	prepareClientToWrite(c)
+	c.buf = buf
+	closeClientOnOutputBufferLimitReached(c)
+}
+
+// prepareClientToWrite installs the write handler unless it is already
+// installed, it is called right before appending to the output buffer.
+func prepareClientToWrite(c *GodisClient) {
+	if !clientHasPendingReplies(c) {
+		c.shard.loop.AeCreateFileEvent(c.fd, AE_WRITABLE, replyToClient, nil)
+	}
+}
+
+// resetOutputBuffer empties the output buffer once everything has been sent,
+// a buffer that grew large for a big reply is released.
+func resetOutputBuffer(c *GodisClient) {
+	c.sentlen = 0
+	if cap(c.buf) > 4*IOBUF_LEN {
+		c.buf = nil
+	} else {
+		c.buf = c.buf[:0]
+	}
+}
+
+// replyToClient writes as much of the output buffer as the socket accepts,
+// the write handler stays installed until the buffer is empty.
 func replyToClient(loop *AeEventLoop, fd int, mask FileEventType, extra interface{}) {
-	if len(server.clients[fd].reply) == 0 {
+	c := shardOf(loop).clients[fd]
+	if c.close_asap {
 		loop.AeDeleteFileEvent(fd, AE_WRITABLE, nil)
 		return
 	}
-	reply := &server.clients[fd].reply[0]
-	data, err := proto.Marshal(reply)
-	if err != nil {
-		log.Printf("replyToClient proto error: %v\n", err)
+	if c.tls != nil {
+		done, err := writeTlsClient(c)
+		if err != nil {
+			log.Printf("replyToClient Write error: %v\n", err)
+			freeClient(c)
+		} else if done && c.close_after_reply {
+			freeClient(c)
+		} else if done && c.stream != nil {
+			continueReplyStream(c)
+		} else if done {
+			loop.AeDeleteFileEvent(fd, AE_WRITABLE, nil)
+		}
 		return
 	}
-	_, err = unix.Write(fd, data)
-	if err != nil {
+	if err := writeToClient(c); err != nil {
 		log.Printf("replyToClient Write error: %v\n", err)
+		freeClient(c)
+		return
+	}
+	if c.sentlen < len(c.buf) {
 		return
 	}
-	server.clients[fd].reply = server.clients[fd].reply[1:]
+	if c.close_after_reply {
+		freeClient(c)
+		return
+	}
+	resetOutputBuffer(c)
+	if c.stream != nil {
+		continueReplyStream(c)
+		return
+	}
+	loop.AeDeleteFileEvent(fd, AE_WRITABLE, nil)
+}
+
+// continueReplyStream serializes the next chunk of the streamed reply once
+// the previous one is written, and runs the requests that waited for the
+// stream once it ends.
+func continueReplyStream(c *GodisClient) {
+	streamNextChunk(c)
+	if c.stream == nil {
+		processInputBuffer(c)
+		freeClientsInAsyncFreeQueue(c.shard)
+	}
+}
+
+// writeToClient writes as much of the output buffer as the socket accepts. It
+// only touches the client, so IO threads run it too.
+func writeToClient(c *GodisClient) error {
+	for c.sentlen < len(c.buf) {
+		n, err := unix.Write(c.fd, c.buf[c.sentlen:])
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.sentlen += n
+		c.last_interaction = GetMsTime()
+	}
+	return nil
+}
+
+// appendReply serializes a reply value in the wire format of the client.
+func appendReply(buf []byte, c *GodisClient, v *myProto.Value) ([]byte, error) {
+	switch c.proto {
+	case PROTO_RESP:
+		return appendRespValue(buf, v, c.resp), nil
+	case PROTO_HTTP:
+		return appendHttpReply(buf, c, v), nil
+	}
+	var reply *myProto.Reply
+	if c.proto_version >= 2 {
+		reply = &myProto.Reply{Value: v}
+	} else {
+		reply = legacyReply(v)
+		// clients that predate versioning decode args as strings and
+		// reject anything that isn't valid UTF-8
+		if c.proto_version == 0 && !replyIsUTF8(reply) {
+			reply = legacyReply(errorValue(str_err_notutf8))
+		}
+	}
+	return appendProtobufReply(buf, c, reply)
+}
+
+// appendProtobufReply serializes a reply as a length-prefixed frame,
+// compressed when the client negotiated it.
+func appendProtobufReply(buf []byte, c *GodisClient, reply *myProto.Reply) ([]byte, error) {
+	reply.Version = PROTOBUF_VERSION
+	if c.compression != "" {
+		reply = compressReply(c, reply)
+	}
+	buf = protowire.AppendVarint(buf, uint64(proto.Size(reply)))
+	return proto.MarshalOptions{UseCachedSize: true}.MarshalAppend(buf, reply)
+}
+
+func replyIsUTF8(reply *myProto.Reply) bool {
+	for _, arg := range reply.Args {
+		if !utf8.Valid(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Go strings hold arbitrary bytes, so keys and values are kept as strings
+// internally and converted as they are at the protocol boundary.
+func bytesToStrings(args [][]byte) []string {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		s[i] = string(arg)
+	}
+	return s
+}
+
+func stringsToBytes(args []string) [][]byte {
+	b := make([][]byte, len(args))
+	for i, arg := range args {
+		b[i] = []byte(arg)
+	}
+	return b
 }
 
 func processClientCommand(c *GodisClient) error {
 	c.last_interaction = GetMsTime()
 	cmd, ok := CommandTable[c.command]
 	if !ok {
-		c.reply = append(c.reply, myProto.Reply{
-			Args:      []string{"ERR unknown command"},
-			ReplyType: int64(RE_ERR),
-		})
-		server.loop.AeCreateFileEvent(c.fd, AE_WRITABLE, replyToClient, nil)
+		addReply(c, errorValue("ERR unknown command"))
+		return nil
+	}
+	if server.requirepass != "" && !c.authenticated && cmd.name != "auth" && cmd.name != "hello" {
+		genReply(c, RE_ERR, &str_err_noauth, 0, nil)
+		return nil
+	}
+	// RESP2 has no out of band replies, so a subscribed connection is
+	// restricted to the pub/sub commands
+	if c.proto == PROTO_RESP && c.resp == 2 && len(c.pubsub_channels) > 0 &&
+		cmd.name != "ping" && cmd.name != "subscribe" && cmd.name != "unsubscribe" {
+		s := fmt.Sprintf("ERR Can't execute '%s': only SUBSCRIBE / UNSUBSCRIBE / PING are allowed in this context", c.command)
+		genReply(c, RE_ERR, &s, 0, nil)
+		return nil
+	}
+	if arityOk(cmd, c.arg_count) && routeToShard(c, getKeysFromCommand(cmd, c.args), cmd.proc) {
 		return nil
 	}
 	cmd.proc(c)
-	server.loop.AeCreateFileEvent(c.fd, AE_WRITABLE, replyToClient, nil)
 	return nil
 }
 
+// loadCmd makes cmd the current command of the client.
+func loadCmd(c *GodisClient, cmd *myProto.Cmd) {
+	c.command = strings.ToLower(string(cmd.Command))
+	c.arg_count = len(cmd.Args)
+	c.args = bytesToStrings(cmd.Args)
+}
+
+// parseProtobufBuffer decodes every complete length-prefixed Cmd frame in
+// the query buffer into pending_cmds and returns how many bytes were
+// consumed. A frame that can't be decoded or is over the limits stops the
+// parsing for good and is recorded in proto_err. It only touches the client,
+// so IO threads run it too.
+func parseProtobufBuffer(c *GodisClient) int {
+	pos := 0
+	for pos < len(c.query_buf) && c.proto_err == "" {
+		if c.frame_len < 0 {
+			size, n := binary.Uvarint(c.query_buf[pos:])
+			if n == 0 {
+				break
+			}
+			if n < 0 {
+				c.proto_err = "invalid frame length"
+				break
+			}
+			if size > uint64(server.client_max_querybuf_len) {
+				c.proto_err = fmt.Sprintf("frame of %d bytes over the query buffer limit", size)
+				break
+			}
+			if server.requirepass != "" && !c.authenticated && size > uint64(PROTO_UNAUTH_MAX_FRAME_LEN) {
+				// the commands before it may authenticate the client, it
+				// is parsed again once they ran
+				if len(c.pending_cmds) == 0 {
+					c.proto_err = fmt.Sprintf("frame of %d bytes over the limit for unauthenticated clients", size)
+				}
+				break
+			}
+			pos += n
+			c.frame_len = int(size)
+		}
+		if len(c.query_buf)-pos < c.frame_len {
+			break
+		}
+		frame := c.query_buf[pos : pos+c.frame_len]
+		pos += c.frame_len
+		c.frame_len = -1
+
+		client_cmd := &myProto.Cmd{}
+		err := proto.Unmarshal(frame, client_cmd)
+		if err != nil {
+			log.Printf("readClient proto error: %v\n", err)
+			c.proto_err = "invalid frame"
+			break
+		}
+		if err := decompressCmd(client_cmd); err != nil {
+			log.Printf("readClient compression error: %v\n", err)
+			c.proto_err = "invalid compressed frame"
+			if errors.Is(err, errInflateLimit) {
+				c.proto_err = "compressed frame over the query buffer limit"
+			}
+			break
+		}
+		if c.proto_err = checkCmdLimits(client_cmd); c.proto_err != "" {
+			break
+		}
+		c.pending_cmds = append(c.pending_cmds, client_cmd)
+	}
+	if c.proto_err != "" {
+		return len(c.query_buf)
+	}
+	return pos
+}
+
+// checkCmdLimits checks the arguments of a command, or of every command of a
+// batch, against proto-max-args and proto-max-bulk-len.
+func checkCmdLimits(cmd *myProto.Cmd) string {
+	if cmd.Batch == nil {
+		return checkArgsLimits(cmd.Args)
+	}
+	if len(cmd.Batch.Cmds) > server.proto_max_args {
+		return "too many commands in batch"
+	}
+	for _, batched := range cmd.Batch.Cmds {
+		if err := checkArgsLimits(batched.Args); err != "" {
+			return err
+		}
+	}
+	return ""
+}
+
+// checkArgsLimits returns the protocol error of a request with more
+// arguments than proto-max-args, the command name included, or with an
+// argument longer than proto-max-bulk-len.
+func checkArgsLimits[T string | []byte](args []T) string {
+	if len(args)+1 > server.proto_max_args {
+		return "invalid multibulk length"
+	}
+	for _, arg := range args {
+		if len(arg) > server.proto_max_bulk_len {
+			return "invalid bulk length"
+		}
+	}
+	return ""
+}
+
+// rejectRequest replies with a protocol error and closes the connection once
+// the reply is sent, the rest of the input can't be trusted.
+func rejectRequest(c *GodisClient, err string) {
+	log.Printf("Protocol error from client %s: %s\n", c.addr, err)
+	atomic.AddInt64(&server.stat_rejected_requests, 1)
+	addReply(c, errorValue("ERR Protocol error: "+err))
+	c.close_after_reply = true
+}
+
+// processPendingCmds runs the commands decoded from the query buffer, until
+// one of them is forwarded to another shard, then replies with the protocol
+// error met after them if any.
+func processPendingCmds(c *GodisClient) {
+	for len(c.pending_cmds) > 0 && !c.blocked {
+		client_cmd := c.pending_cmds[0]
+		c.pending_cmds = c.pending_cmds[1:]
+		log.Printf("recv: %v\n", client_cmd)
+		c.proto_version = client_cmd.Version
+		negotiateCompression(c, client_cmd.Compression)
+		if client_cmd.Batch != nil {
+			processCmdBatch(c, client_cmd.Batch)
+			continue
+		}
+		loadCmd(c, client_cmd)
+		err := processClientCommand(c)
+		if err != nil {
+			log.Printf("readClient process error: %v\n", err)
+		}
+	}
+	if len(c.pending_cmds) > 0 || c.blocked {
+		return
+	}
+	c.pending_cmds = nil
+	if c.proto_err != "" && !c.close_after_reply {
+		rejectRequest(c, c.proto_err)
+	}
+}
+
+// processRespBuffer consumes every complete RESP request in the query buffer,
+// and what was parsed of the last one if incomplete, and returns how many
+// bytes were consumed.
+func processRespBuffer(c *GodisClient) int {
+	pos := 0
+	for pos < len(c.query_buf) && !c.blocked {
+		args, n, done, err := c.resp_parser.parse(c.query_buf[pos:], server.proto_max_args, server.proto_max_bulk_len)
+		if err != nil {
+			rejectRequest(c, strings.TrimPrefix(err.Error(), "Protocol error: "))
+			return len(c.query_buf)
+		}
+		pos += n
+		if !done {
+			break
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.command = strings.ToLower(args[0])
+		c.arg_count = len(args) - 1
+		c.args = args[1:]
+		err = processClientCommand(c)
+		if err != nil {
+			log.Printf("readClient process error: %v\n", err)
+		}
+	}
+	return pos
+}
+
+// processInputBuffer runs every complete request in the query buffer. A
+// partial request is kept until the next read completes it.
+func processInputBuffer(c *GodisClient) {
+	// nothing more is read from a client that is about to be closed
+	if c.close_after_reply {
+		c.query_buf = c.query_buf[:0]
+		return
+	}
+	// the rest of the input waits for the forwarded command to reply
+	if c.blocked {
+		return
+	}
+	// the requests read before a shutdown aren't run, a forwarded command
+	// or a streamed reply ending only leaves its replies to write
+	if c.shard.shutting_down {
+		return
+	}
+	switch c.proto {
+	case PROTO_RESP:
+		compactQueryBuffer(c, processRespBuffer(c))
+	case PROTO_HTTP:
+		compactQueryBuffer(c, processHttpBuffer(c))
+	default:
+		for {
+			compactQueryBuffer(c, parseProtobufBuffer(c))
+			parsed := len(c.pending_cmds) > 0
+			processPendingCmds(c)
+			// the parsing stops at a big frame of an unauthenticated
+			// client, the commands before it may have authenticated it
+			if !parsed || len(c.pending_cmds) > 0 || c.blocked || c.close_after_reply || len(c.query_buf) == 0 {
+				break
+			}
+		}
+	}
+}
+
+// compactQueryBuffer drops the first pos bytes of the query buffer, keeping
+// the partial request at its front for the next read.
+func compactQueryBuffer(c *GodisClient, pos int) {
+	c.query_buf = c.query_buf[:copy(c.query_buf, c.query_buf[pos:])]
+	if len(c.query_buf) == 0 && cap(c.query_buf) > 4*IOBUF_LEN {
+		c.query_buf = nil
+	}
+}
+
 func readClient(loop *AeEventLoop, fd int, mask FileEventType, extra interface{}) {
-	n, err := unix.Read(fd, server.clients[fd].read_buf[:])
-	if err != nil {
-		log.Printf("readClient read error: %v\n", err)
+	s := shardOf(loop)
+	c := s.clients[fd]
+	if c.tls != nil {
+		readTlsClient(c)
 		return
 	}
-	if n == 0 {
+	if postponeClientRead(c) {
 		return
 	}
-	var client_cmd myProto.Cmd
-	err = proto.Unmarshal(server.clients[fd].read_buf[:n], &client_cmd)
-	if err != nil {
-		log.Printf("readClient proto error: %v\n", err)
+	if err := readQueryFromClient(c); err != nil {
+		freeClientOnReadError(c, err)
 		return
 	}
-	log.Printf("recv: %v\n", &client_cmd)
-	server.clients[fd].command = strings.ToLower(client_cmd.Command)
-	server.clients[fd].arg_count = len(client_cmd.Args)
-	server.clients[fd].args = client_cmd.GetArgs()
-	err = processClientCommand(server.clients[fd])
+	processInputBuffer(c)
+	freeClientsInAsyncFreeQueue(s)
+}
+
+// errQueryBufferLimit is returned by a read that took the query buffer over
+// client-query-buffer-limit.
+var errQueryBufferLimit = errors.New("query buffer limit reached")
+
+// freeClientOnReadError frees a client whose socket failed or closed, or
+// whose query buffer is over the limit.
+func freeClientOnReadError(c *GodisClient, err error) {
+	switch err {
+	case io.EOF:
+	case errQueryBufferLimit:
+		log.Printf("Closing client %s that reached max query buffer length (qbuf=%d)\n", c.addr, len(c.query_buf))
+		atomic.AddInt64(&server.stat_qbuf_limit_disconnections, 1)
+	default:
+		log.Printf("readClient read error: %v\n", err)
+	}
+	freeClient(c)
+}
+
+// readQueryFromClient appends what the socket holds to the query buffer,
+// returns io.EOF once the peer closed the connection and errQueryBufferLimit
+// once the buffer is over the limit, which a client that keeps sending while
+// its commands wait can reach. It only touches the client, so IO threads run
+// it too.
+func readQueryFromClient(c *GodisClient) error {
+	readlen := IOBUF_LEN
+	// a big frame is read in bigger chunks as it arrives, the buffer at most
+	// doubles on each read so the length the client claims is never
+	// allocated before the bytes are there
+	if remaining := c.frame_len - len(c.query_buf); c.frame_len > 0 && remaining > readlen {
+		readlen = min(remaining, max(readlen, len(c.query_buf)))
+	}
+	qblen := len(c.query_buf)
+	if cap(c.query_buf)-qblen < readlen {
+		buf := make([]byte, qblen, qblen+readlen)
+		copy(buf, c.query_buf)
+		c.query_buf = buf
+	}
+	n, err := unix.Read(c.fd, c.query_buf[qblen:qblen+readlen])
+	if err == unix.EAGAIN {
+		return nil
+	}
 	if err != nil {
-		log.Printf("readClient process error: %v\n", err)
+		return err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	c.query_buf = c.query_buf[:qblen+n]
+	// a client sending a big request isn't idle
+	c.last_interaction = GetMsTime()
+	if len(c.query_buf) > server.client_max_querybuf_len {
+		return errQueryBufferLimit
 	}
+	return nil
 }
 
-func createClient(fd int) *GodisClient {
+func createClient(s *GodisShard, fd int, protocol ClientProto) *GodisClient {
+	atomic.AddInt64(&server.stat_numconnections, 1)
 	client := &GodisClient{
 		fd:               fd,
-		db:               server.db[0],
+		shard:            s,
+		proto:            protocol,
+		resp:             2,
+		authenticated:    false,
+		pubsub_channels:  make(map[string]bool),
+		db:               s.db[0],
 		db_id:            0,
 		name:             "",
 		arg_count:        0,
 		command:          "",
 		args:             []string{},
-		reply:            []myProto.Reply{},
+		buf:              []byte{},
+		sentlen:          0,
+		addr:             peerAddr(fd),
+		close_asap:       false,
 		ctime:            GetMsTime(),
 		last_interaction: GetMsTime(),
-		read_buf:         [1024]byte{},
+		query_buf:        []byte{},
+		frame_len:        -1,
 	}
 	return client
 }
 
+// freeClient closes the connection of a client and releases everything it
+// holds: its events, its pending output and its subscriptions.
+func freeClient(c *GodisClient) {
+	if c.shard.clients[c.fd] != c {
+		return
+	}
+	pubsubUnsubscribeAllChannels(c, false)
+	c.deferred_replies = nil
+	freeReplyStream(c)
+	if c.tls != nil {
+		c.tls.close()
+	}
+	c.shard.loop.AeDeleteFileEvent(c.fd, AE_READABLE|AE_WRITABLE, nil)
+	unix.Close(c.fd)
+	delete(c.shard.clients, c.fd)
+	atomic.AddInt64(&server.connected_clients, -1)
+	c.buf = nil
+	c.sentlen = 0
+	c.query_buf = nil
+	c.pending_cmds = nil
+	c.pending_values = nil
+	c.pending_values_len = 0
+}
+
+// handleClient accepts a connection on a listening socket, extra holds the
+// ClientProto spoken on that socket.
 func handleClient(loop *AeEventLoop, fd int, mask FileEventType, extra interface{}) {
-	nfd, _, err := unix.Accept(fd)
+	nfd, sa, err := unix.Accept(fd)
 	if err != nil {
 		log.Printf("handleClient-Accept err: %v\n", err)
 		return
 	}
-	server.clients[nfd] = createClient(nfd)
-	server.loop.AeCreateFileEvent(nfd, AE_READABLE, readClient, nil)
+	err = unix.SetNonblock(nfd, true)
+	if err != nil {
+		log.Printf("handleClient-SetNonblock err: %v\n", err)
+		unix.Close(nfd)
+		return
+	}
+	if _, isUnix := sa.(*unix.SockaddrUnix); !isUnix && server.tcpkeepalive > 0 {
+		err = KeepAlive(nfd, server.tcpkeepalive)
+		if err != nil {
+			log.Printf("handleClient-KeepAlive err: %v\n", err)
+		}
+	}
+	protocol, ok := extra.(ClientProto)
+	if !ok {
+		protocol = PROTO_PROTOBUF
+	}
+	acceptCommonHandler(shardOf(loop), nfd, protocol, false)
+}
 
+// handleTlsClient accepts a connection on the tls port, the handshake is
+// driven by readClient and replyToClient.
+func handleTlsClient(loop *AeEventLoop, fd int, mask FileEventType, extra interface{}) {
+	nfd, sa, err := unix.Accept(fd)
+	if err != nil {
+		log.Printf("handleTlsClient-Accept err: %v\n", err)
+		return
+	}
+	err = unix.SetNonblock(nfd, true)
+	if err != nil {
+		log.Printf("handleTlsClient-SetNonblock err: %v\n", err)
+		unix.Close(nfd)
+		return
+	}
+	if _, isUnix := sa.(*unix.SockaddrUnix); !isUnix && server.tcpkeepalive > 0 {
+		err = KeepAlive(nfd, server.tcpkeepalive)
+		if err != nil {
+			log.Printf("handleTlsClient-KeepAlive err: %v\n", err)
+		}
+	}
+	acceptCommonHandler(shardOf(loop), nfd, PROTO_PROTOBUF, true)
+}
+
+// acceptCommonHandler turns an accepted connection into a client of the
+// shard, or rejects it with an error once maxclients clients are connected
+// to the whole server.
+func acceptCommonHandler(s *GodisShard, fd int, protocol ClientProto, useTls bool) {
+	if atomic.LoadInt64(&server.connected_clients) >= int64(server.maxclients) {
+		// best effort: the socket is new so the reply fits in its send
+		// buffer. A TLS client gets no reply since no handshake happened yet.
+		if !useTls {
+			c := &GodisClient{fd: fd, proto: protocol, resp: 2, close_after_reply: true}
+			buf, _ := appendReply(nil, c, errorValue(str_err_maxclients))
+			unix.Write(fd, buf)
+		}
+		atomic.AddInt64(&server.stat_rejected_conn, 1)
+		unix.Close(fd)
+		return
+	}
+	c := createClient(s, fd, protocol)
+	if useTls {
+		c.tls = createTlsConn(fd)
+	}
+	s.clients[fd] = c
+	atomic.AddInt64(&server.connected_clients, 1)
+	s.loop.AeCreateFileEvent(fd, AE_READABLE, readClient, nil)
 }
 
 func initServerConfig() {
-	server = &GodisServer{
-		ip:                    "127.0.0.1",
-		port:                  9736,
-		db_count:              10,
-		expire_check_count:    10,
-		expire_check_interval: 100,
+	server = newServerConfig()
+}
+
+// newServerConfig returns a server with the default settings.
+func newServerConfig() *GodisServer {
+	return &GodisServer{
+		bindaddr:                []string{"127.0.0.1"},
+		port:                    9736,
+		resp_port:               6379,
+		http_port:               0,
+		requirepass:             "",
+		maxclients:              MAXCLIENTS_DEFAULT,
+		maxidletime:             0,
+		tcpkeepalive:            300,
+		compression_threshold:   COMPRESSION_THRESHOLD_DEFAULT,
+		reply_chunk_len:         REPLY_CHUNK_LEN_DEFAULT,
+		client_max_querybuf_len: CLIENT_MAX_QUERYBUF_LEN_DEFAULT,
+		proto_max_bulk_len:      PROTO_MAX_BULK_LEN_DEFAULT,
+		proto_max_args:          PROTO_MAX_ARGS_DEFAULT,
+		io_threads_num:          1,
+		io_threads_do_reads:     true,
+		shards_num:              1,
+		poller:                  AE_POLLER_EPOLL,
+		shutdown_timeout:        SHUTDOWN_TIMEOUT_DEFAULT,
+		tls_port:                0,
+		tls_auth_clients:        TLS_CLIENT_AUTH_YES,
+		unixsocket:              "",
+		unixsocketperm:          0,
+		db_count:                10,
+		expire_check_count:      10,
+		expire_check_interval:   100,
+		hz:                      10,
+		client_obuf_limits: [CLIENT_TYPE_COUNT]ClientBufferLimit{
+			CLIENT_TYPE_NORMAL:  {0, 0, 0},
+			CLIENT_TYPE_REPLICA: {256 << 20, 64 << 20, 60},
+			CLIENT_TYPE_PUBSUB:  {32 << 20, 8 << 20, 60},
+		},
 	}
 
 }
 
+// adjustOpenFilesLimit raises the open files limit so that maxclients
+// clients fit next to the fds the server uses for itself. When the limit
+// can't be raised enough maxclients is lowered to what the limit allows.
+func adjustOpenFilesLimit() {
+	reserved := MIN_RESERVED_FDS * server.shards_num
+	maxfiles := uint64(server.maxclients + reserved)
+	var limit unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		log.Printf("Unable to obtain the current NOFILE limit (%v), assuming 1024 and setting the max clients configuration accordingly.\n", err)
+		server.maxclients = 1024 - reserved
+		return
+	}
+	oldlimit := limit.Cur
+	if oldlimit >= maxfiles {
+		return
+	}
+	// try to set the limit to maxfiles, and lower it step by step if the
+	// hard limit or the permissions don't allow it
+	bestlimit := maxfiles
+	for bestlimit > oldlimit {
+		limit.Cur = min(bestlimit, limit.Max)
+		if limit.Cur > oldlimit && unix.Setrlimit(unix.RLIMIT_NOFILE, &limit) == nil {
+			break
+		}
+		limit.Cur = oldlimit
+		if bestlimit < 16 {
+			break
+		}
+		bestlimit -= 16
+	}
+	if limit.Cur < maxfiles {
+		if limit.Cur <= uint64(reserved) {
+			log.Panicf("Your current 'ulimit -n' of %d is not enough for the server to start.\n", limit.Cur)
+		}
+		old := server.maxclients
+		server.maxclients = int(limit.Cur) - reserved
+		log.Printf("Server can't set maximum open files to %d, maxclients has been reduced from %d to %d.\n", maxfiles, old, server.maxclients)
+	} else {
+		log.Printf("Increased maximum number of open files to %d (it was originally set to %d).\n", limit.Cur, oldlimit)
+	}
+}
+
 func initServer() {
+	server.configured_io_threads_num = server.io_threads_num
+	server.configured_poller = server.poller
+	adjustOpenFilesLimit()
+
 	//command table
 	initCommandTable()
+	server.stat_starttime = GetMsTime()
 
-	//server db
-	server.db = make(map[int]*GodisDB)
-	for i := 0; i < server.db_count; i++ {
-		server.db[i] = &GodisDB{
-			dict:    make(map[string]*GodisObj),
-			expires: make(map[string]int),
+	if server.tls_port != 0 {
+		var err error
+		server.tls_config, err = tlsConfigure()
+		if err != nil {
+			panic(err)
 		}
 	}
-	//server client
-	server.clients = make(map[int]*GodisClient)
+	// the IO threads would share the clients of one loop, shards give each
+	// loop its own clients instead
+	if server.shards_num > 1 && server.io_threads_num > 1 {
+		log.Printf("io-threads is ignored when the server runs %d shards.\n", server.shards_num)
+		server.io_threads_num = 1
+	}
 
-	//server fd
-	listen, err := TcpSocket(server.ip, server.port)
-	if err != nil {
-		panic(err)
+	//shards, each with its keyspace, its aeloop and its listeners
+	server.shards = nil
+	for i := 0; i < server.shards_num; i++ {
+		server.shards = append(server.shards, createShard(i))
 	}
-	server.fd = listen
 
-	//aeloop
-	lp, err := AeCreateEventLoop()
-	if err != nil {
-		panic(err)
+	//unix socket fd, unix sockets can't be shared so the first shard
+	//accepts every connection
+	server.sofd = -1
+	if server.unixsocket != "" {
+		listen, err := UnixSocket(server.unixsocket, server.unixsocketperm)
+		if err != nil {
+			panic(err)
+		}
+		server.sofd = listen
+		server.shards[0].loop.AeCreateFileEvent(server.sofd, AE_READABLE, handleClient, PROTO_PROTOBUF)
 	}
-	server.loop = lp
-	server.loop.AeCreateFileEvent(listen, AE_READABLE, handleClient, nil)
-	server.loop.AeCreateTimeEvent(0, AE_NORMAL, findExpiredKey, nil)
+	initThreadedIO()
 
 }
 
+// listenToPort binds port on every address of bindaddr. An address that
+// can't be bound is skipped, it is an error only if none of them can be.
+func listenToPort(port int) ([]int, error) {
+	fds := []int{}
+	for _, addr := range server.bindaddr {
+		fd, err := TcpSocket(addr, port)
+		if err != nil {
+			log.Printf("Could not create server TCP listening socket %s:%d: %v\n", addr, port, err)
+			continue
+		}
+		fds = append(fds, fd)
+	}
+	if len(fds) == 0 {
+		return nil, fmt.Errorf("Failed listening on port %d (tcp) on any of %v, aborting", port, server.bindaddr)
+	}
+	return fds, nil
+}
+
+// closeListeningSockets closes every listening socket and removes the unix
+// socket file.
+func closeListeningSockets() {
+	for _, s := range server.shards {
+		closeShardListeningSockets(s)
+	}
+}
+
+// closeShardListeningSockets closes the listening sockets of the shard, the
+// unix socket belonging to the first one.
+func closeShardListeningSockets(s *GodisShard) {
+	for _, fds := range [][]int{s.ipfd, s.resp_ipfd, s.http_ipfd, s.tls_ipfd} {
+		for _, fd := range fds {
+			s.loop.AeDeleteFileEvent(fd, AE_READABLE, nil)
+			unix.Close(fd)
+		}
+	}
+	s.ipfd, s.resp_ipfd, s.http_ipfd, s.tls_ipfd = nil, nil, nil, nil
+	if s.id == 0 && server.sofd != -1 {
+		s.loop.AeDeleteFileEvent(server.sofd, AE_READABLE, nil)
+		unix.Close(server.sofd)
+		server.sofd = -1
+		os.Remove(server.unixsocket)
+	}
+}
+
 var server *GodisServer = nil
 
-func Run() {
+// Run starts the server, configfile may be empty to use the defaults.
+func Run(configfile string) {
 	initServerConfig()
-	//TODO :read config from file
+	if configfile != "" {
+		err := loadServerConfig(configfile)
+		if err != nil {
+			log.Fatalf("Fatal error, can't load config: %v\n", err)
+		}
+		server.configfile = configfile
+	}
+	if err := openLogFile(); err != nil {
+		log.Fatalf("Fatal error, can't open the log file %s: %v\n", server.logfile, err)
+	}
 	initServer()
+	initSignalHandlers()
 
-	server.loop.AeMain()
+	// the first shard runs on the calling goroutine
+	var wg sync.WaitGroup
+	for _, s := range server.shards[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.loop.AeMain()
+		}()
+	}
+	server.shards[0].loop.AeMain()
+	wg.Wait()
+	stopSignalHandlers()
+	killThreadedIO()
+	closeListeningSockets()
+	log.Printf("Godis is now ready to exit, bye bye...\n")
 }
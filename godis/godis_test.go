@@ -0,0 +1,593 @@
+package godis
+
+import (
+	"bufio"
+	"fmt"
+	myProto "godisdb/proto"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() returned an error: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestServer runs a server on a free port until the test ends.
+// config may adjust the server settings before the server is initialized.
+func startTestServer(t testing.TB, config func()) {
+	initServerConfig()
+	server.port = freePort(t)
+	server.resp_port = freePort(t)
+	if config != nil {
+		config()
+	}
+	initServer()
+	var wg sync.WaitGroup
+	for _, s := range server.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.loop.AeMain()
+		}()
+	}
+	t.Cleanup(func() {
+		stopShards()
+		wg.Wait()
+		killThreadedIO()
+		closeListeningSockets()
+		for _, s := range server.shards {
+			s.loop.AeDeleteEventLoop()
+		}
+	})
+}
+
+func dialTestServer(t *testing.T) net.Conn {
+	return dialTestPort(t, server.port)
+}
+
+func dialTestPort(t *testing.T, port int) net.Conn {
+	conn, err := net.Dial("tcp", net.JoinHostPort(server.bindaddr[0], strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("net.Dial() returned an error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func appendCmd(buf []byte, command string, args ...string) []byte {
+	cmd := &myProto.Cmd{
+		Command: []byte(command),
+		Args:    stringsToBytes(args),
+		Version: PROTOBUF_VERSION,
+	}
+	buf = protowire.AppendVarint(buf, uint64(proto.Size(cmd)))
+	buf, _ = proto.MarshalOptions{}.MarshalAppend(buf, cmd)
+	return buf
+}
+
+// readReply reads a reply, putting the chunks of a streamed one together.
+func readReply(t *testing.T, r *bufio.Reader) *myProto.Value {
+	var value *myProto.Value
+	for {
+		var reply myProto.Reply
+		err := protodelim.UnmarshalOptions{MaxSize: -1}.UnmarshalFrom(r, &reply)
+		if err != nil {
+			t.Fatalf("UnmarshalFrom() returned an error: %v", err)
+		}
+		if reply.Value == nil {
+			t.Fatalf("got a reply without a value: %v", &reply)
+		}
+		value = MergeReplyChunk(value, reply.Value)
+		if !reply.More {
+			return value
+		}
+	}
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	big := strings.Repeat("v", 200*1024)
+	var buf []byte
+	buf = appendCmd(buf, "set", "big", big)
+	for i := 0; i < 100; i++ {
+		buf = appendCmd(buf, "set", fmt.Sprintf("key%d", i), fmt.Sprintf("%d", i))
+	}
+	buf = appendCmd(buf, "get", "key42")
+	// deliver the batch in uneven pieces so frames straddle reads
+	for len(buf) > 0 {
+		n := 7777
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			t.Fatalf("Write() returned an error: %v", err)
+		}
+		buf = buf[n:]
+	}
+
+	for i := 0; i < 101; i++ {
+		if reply := readReply(t, r); reply.GetStatus() != "OK" {
+			t.Fatalf("reply %d: got %v, want OK", i, reply)
+		}
+	}
+	reply := readReply(t, r)
+	if string(reply.GetBulk()) != "42" {
+		t.Fatalf("get key42 returned %v", reply)
+	}
+
+	conn.Write(appendCmd(nil, "get", "big"))
+	reply = readReply(t, r)
+	if string(reply.GetBulk()) != big {
+		t.Fatal("get big did not return the whole value")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godis.sock")
+	t.Cleanup(func() {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Error("the unix socket file was not removed on shutdown")
+		}
+	})
+	// a stale socket file must not prevent the server from starting
+	os.WriteFile(path, nil, 0600)
+	startTestServer(t, func() {
+		server.unixsocket = path
+		server.unixsocketperm = 0700
+	})
+	if st, err := os.Stat(path); err != nil || st.Mode().Perm() != 0700 {
+		t.Fatalf("unix socket file stat: %v, %v", st, err)
+	}
+
+	uconn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("net.Dial() returned an error: %v", err)
+	}
+	defer uconn.Close()
+	tconn := dialTestServer(t)
+	for _, conn := range []net.Conn{uconn, tconn} {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(appendCmd(nil, "ping"))
+		if reply := readReply(t, bufio.NewReader(conn)); reply.GetStatus() != "PONG" {
+			t.Errorf("ping over %s returned %v", conn.LocalAddr().Network(), reply)
+		}
+	}
+}
+
+func TestMultipleBindAddresses(t *testing.T) {
+	startTestServer(t, func() { server.bindaddr = []string{"127.0.0.1", "::1"} })
+	if len(server.shards[0].ipfd) != 2 {
+		t.Fatalf("got %d listening sockets, want 2", len(server.shards[0].ipfd))
+	}
+	for _, addr := range server.bindaddr {
+		conn, err := net.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(server.port)))
+		if err != nil {
+			t.Fatalf("net.Dial(%s) returned an error: %v", addr, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(appendCmd(nil, "ping"))
+		if reply := readReply(t, bufio.NewReader(conn)); reply.GetStatus() != "PONG" {
+			t.Errorf("ping over %s returned %v", addr, reply)
+		}
+	}
+}
+
+func TestListenToPortFailure(t *testing.T) {
+	initServerConfig()
+	server.bindaddr = []string{"192.0.2.1", "not-an-address"}
+	if fds, err := listenToPort(freePort(t)); err == nil {
+		t.Errorf("listenToPort() bound %v on unusable addresses", fds)
+	}
+}
+
+// TestPollPoller serves clients with the event loops polling with poll(2).
+func TestPollPoller(t *testing.T) {
+	startTestServer(t, func() {
+		server.poller = AE_POLLER_POLL
+		server.shards_num = 2
+	})
+	big := strings.Repeat("x", 4*1024*1024)
+	conns := make([]net.Conn, 4)
+	for i := range conns {
+		conns[i] = dialTestServer(t)
+		conns[i].SetDeadline(time.Now().Add(5 * time.Second))
+		conns[i].Write(appendCmd(appendCmd(nil, "set", fmt.Sprintf("{big}%d", i), big), "get", fmt.Sprintf("{big}%d", i)))
+	}
+	for i, conn := range conns {
+		r := bufio.NewReader(conn)
+		if reply := readReply(t, r); reply.GetStatus() != "OK" {
+			t.Fatalf("client %d: set returned %v", i, reply)
+		}
+		if reply := readReply(t, r); string(reply.GetBulk()) != big {
+			t.Fatalf("client %d: get did not return the whole value", i)
+		}
+	}
+
+	conns[0].Write(appendCmd(nil, "info", "server"))
+	if info := string(readReply(t, bufio.NewReader(conns[0])).GetBulk()); !strings.Contains(info, "multiplexing_api:poll\r\n") {
+		t.Fatalf("INFO server doesn't report the poll poller:\n%s", info)
+	}
+}
+
+func TestSlowReaderLargeReplies(t *testing.T) {
+	startTestServer(t, nil)
+	slow := dialTestServer(t)
+	slow.SetDeadline(time.Now().Add(10 * time.Second))
+	big := strings.Repeat("x", 4*1024*1024)
+	buf := appendCmd(nil, "set", "big", big)
+	for i := 0; i < 8; i++ {
+		buf = appendCmd(buf, "get", "big")
+	}
+	go slow.Write(buf)
+
+	// the server keeps serving others while the slow reader's buffer is full
+	time.Sleep(100 * time.Millisecond)
+	other := dialTestServer(t)
+	other.SetDeadline(time.Now().Add(2 * time.Second))
+	other.Write(appendCmd(nil, "ping"))
+	if reply := readReply(t, bufio.NewReader(other)); reply.GetStatus() != "PONG" {
+		t.Fatalf("ping returned %v", reply)
+	}
+
+	r := bufio.NewReader(slow)
+	if reply := readReply(t, r); reply.GetStatus() != "OK" {
+		t.Fatalf("set returned %v", reply)
+	}
+	for i := 0; i < 8; i++ {
+		if reply := readReply(t, r); string(reply.GetBulk()) != big {
+			t.Fatalf("get %d did not return the whole value", i)
+		}
+	}
+}
+
+func countOpenFds(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can't list open fds: %v", err)
+	}
+	return len(entries)
+}
+
+func TestClientDisconnect(t *testing.T) {
+	startTestServer(t, nil)
+	before := countOpenFds(t)
+	for i := 0; i < 100; i++ {
+		conn := dialTestPort(t, server.resp_port)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// a subscriber that hangs up with replies still queued
+		conn.Write([]byte("subscribe news\r\n"))
+		conn.Close()
+	}
+
+	pub := dialTestPort(t, server.resp_port)
+	pub.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(pub)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		pub.Write([]byte("publish news hello\r\n"))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString() returned an error: %v", err)
+		}
+		// the server side fds of the closed clients are released too
+		if line == ":0\r\n" && countOpenFds(t) <= before+2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("disconnected clients were not freed, publish returned %q, %d fds open, %d before", line, countOpenFds(t), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	startTestServer(t, func() {
+		server.maxidletime = 1
+		server.hz = 100
+	})
+	idle := dialTestServer(t)
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	sub := dialTestPort(t, server.resp_port)
+	sub.SetDeadline(time.Now().Add(5 * time.Second))
+	sub.Write([]byte("subscribe news\r\n"))
+	r := bufio.NewReader(sub)
+	for line := ""; line != ":1\r\n"; {
+		var err error
+		if line, err = r.ReadString('\n'); err != nil {
+			t.Fatalf("ReadString() returned an error: %v", err)
+		}
+	}
+
+	// the idle client is closed after about a second
+	start := time.Now()
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the idle client received data")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the idle client was not closed")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("the idle client was closed after %v", elapsed)
+	}
+
+	// the subscriber is still served
+	sub.Write([]byte("ping\r\n"))
+	if line, err := r.ReadString('\n'); err != nil {
+		t.Errorf("the subscriber was closed: %v", err)
+	} else if line != "+PONG\r\n" {
+		t.Errorf("ping returned %q", line)
+	}
+}
+
+func TestClientTimeoutSlowUpload(t *testing.T) {
+	startTestServer(t, func() {
+		server.maxidletime = 1
+		server.hz = 100
+	})
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// a request sent in pieces over more than the timeout isn't idle
+	buf := appendCmd(nil, "set", "k", strings.Repeat("x", 3000))
+	for len(buf) > 100 {
+		if _, err := conn.Write(buf[:100]); err != nil {
+			t.Fatalf("the client was closed while sending: %v", err)
+		}
+		buf = buf[100:]
+		time.Sleep(100 * time.Millisecond)
+	}
+	conn.Write(buf)
+	if reply := readReply(t, bufio.NewReader(conn)); reply.GetStatus() != "OK" {
+		t.Fatalf("set returned %v", reply)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	startTestServer(t, func() {
+		server.maxclients = 2
+	})
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn := dialTestServer(t)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(appendCmd(nil, "ping"))
+		readReply(t, bufio.NewReader(conn))
+		conns = append(conns, conn)
+	}
+
+	// one client too many gets an error and is closed
+	conn := dialTestPort(t, server.resp_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || line != "-ERR max number of clients reached\r\n" {
+		t.Errorf("the extra client got %q, %v", line, err)
+	}
+	if _, err = r.ReadByte(); err == nil {
+		t.Error("the extra client was not closed")
+	}
+
+	// a client is accepted again once one has left
+	conns[0].Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn := dialTestServer(t)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(appendCmd(nil, "info", "stats"))
+		reply := readReply(t, bufio.NewReader(conn))
+		if info := reply.GetBulk(); info != nil {
+			if !strings.Contains(string(info), "rejected_connections:1\r\n") {
+				t.Errorf("info stats returned %q", info)
+			}
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("no client accepted after a disconnection, got %v", reply)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBinarySafeValues(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	blob := "\x00\xff\xfe\r\n\x89PNG"
+	key := "key\x00\xc3"
+
+	for _, tc := range []struct {
+		cmd  []string
+		want []string
+	}{
+		{[]string{"set", key, blob}, []string{"OK"}},
+		{[]string{"get", key}, []string{blob}},
+		{[]string{"hset", "h" + key, blob, blob}, []string{"1"}},
+		{[]string{"hget", "h" + key, blob}, []string{blob}},
+		{[]string{"rpush", "l" + key, blob}, []string{"1"}},
+		{[]string{"lrange", "l" + key, "0", "-1"}, []string{blob}},
+		{[]string{"sadd", "s" + key, blob}, []string{"1"}},
+		{[]string{"smembers", "s" + key}, []string{blob}},
+		{[]string{"zadd", "z" + key, "1", blob}, []string{"1"}},
+		{[]string{"zrange", "z" + key, "0", "2"}, []string{blob}},
+	} {
+		conn.Write(appendCmd(nil, tc.cmd[0], tc.cmd[1:]...))
+		reply := readReply(t, r)
+		got := bytesToStrings(flattenValue(nil, reply))
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s returned %q, want %q", tc.cmd[0], got, tc.want)
+		}
+	}
+
+	// a client that predates versioning gets an error instead of a reply
+	// it can't decode
+	old, _ := proto.Marshal(&myProto.Cmd{Command: []byte("get"), Args: [][]byte{[]byte(key)}})
+	conn.Write(protowire.AppendVarint(nil, uint64(len(old))))
+	conn.Write(old)
+	var reply myProto.Reply
+	if err := (protodelim.UnmarshalOptions{}).UnmarshalFrom(r, &reply); err != nil {
+		t.Fatalf("UnmarshalFrom() returned an error: %v", err)
+	}
+	if reply.ReplyType != int64(RE_ERR) {
+		t.Errorf("an unversioned client got %q", reply.Args)
+	}
+}
+
+// expectClosed reads until the server closes the connection, failing if it
+// sends anything more.
+func expectClosed(t *testing.T, r *bufio.Reader) {
+	t.Helper()
+	if b, err := r.ReadByte(); err == nil {
+		t.Fatalf("the connection is still open, read %q", b)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	startTestServer(t, func() {
+		server.proto_max_args = 3
+		server.proto_max_bulk_len = 10
+	})
+	requests := []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{"too long", appendCmd(nil, "set", "k", "12345678901"), "invalid bulk length"},
+		{"too many args", appendCmd(nil, "del", "a", "b", "c"), "invalid multibulk length"},
+		{"malformed", []byte{3, 0xff, 0xff, 0xff}, "invalid frame"},
+		{"too large", []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, "frame of 4294967295 bytes over the query buffer limit"},
+	}
+	for _, req := range requests {
+		conn := dialTestServer(t)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		// the commands before the bad one run, the ones after it don't
+		buf := appendCmd(nil, "set", "k", "v")
+		buf = append(buf, req.buf...)
+		conn.Write(appendCmd(buf, "get", "k"))
+		if reply := readReply(t, r); reply.GetStatus() != "OK" {
+			t.Fatalf("%s: set before the bad request returned %v", req.name, reply)
+		}
+		if reply := readReply(t, r); reply.GetError() != "ERR Protocol error: "+req.err {
+			t.Fatalf("%s: got %v", req.name, reply)
+		}
+		expectClosed(t, r)
+	}
+
+	resp := dialTestPort(t, server.resp_port)
+	resp.SetDeadline(time.Now().Add(5 * time.Second))
+	rr := bufio.NewReader(resp)
+	respRoundTrip(t, resp, rr, "*4\r\n$3\r\ndel\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "-ERR Protocol error: invalid multibulk length\r\n")
+	expectClosed(t, rr)
+
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write(appendCmd(nil, "info", "stats"))
+	if info := string(readReply(t, r).GetBulk()); !strings.Contains(info, "rejected_requests:5\r\n") {
+		t.Fatalf("INFO stats doesn't count 5 rejected requests:\n%s", info)
+	}
+}
+
+func TestQueryBufferLimit(t *testing.T) {
+	startTestServer(t, func() {
+		server.client_max_querybuf_len = 64 * 1024
+	})
+	resp := dialTestPort(t, server.resp_port)
+	resp.SetDeadline(time.Now().Add(5 * time.Second))
+	// a bulk that never ends keeps growing the query buffer
+	resp.Write([]byte("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1000000\r\n"))
+	resp.Write(make([]byte, 128*1024))
+	expectClosed(t, bufio.NewReader(resp))
+
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(appendCmd(nil, "info", "stats"))
+	info := string(readReply(t, bufio.NewReader(conn)).GetBulk())
+	if !strings.Contains(info, "client_query_buffer_limit_disconnections:1\r\n") {
+		t.Fatalf("INFO stats doesn't count the disconnection:\n%s", info)
+	}
+}
+
+func TestHugeFrameHeader(t *testing.T) {
+	startTestServer(t, nil)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	// the length a frame claims isn't allocated before its bytes arrive
+	for i := 0; i < 4; i++ {
+		conn := dialTestServer(t)
+		conn.Write(protowire.AppendVarint(nil, 512*1024*1024))
+		conn.Write([]byte{0, 0})
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(appendCmd(nil, "ping"))
+	readReply(t, bufio.NewReader(conn))
+	runtime.ReadMemStats(&after)
+	if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > 64*1024*1024 {
+		t.Fatalf("the heap grew by %d bytes", grown)
+	}
+}
+
+func TestUnauthenticatedFrameLimit(t *testing.T) {
+	startTestServer(t, func() {
+		server.requirepass = "secret"
+	})
+	big := strings.Repeat("x", 2*PROTO_UNAUTH_MAX_FRAME_LEN)
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	// the ping announces the protocol version of the replies
+	conn.Write(protowire.AppendVarint(appendCmd(nil, "ping"), 512*1024*1024))
+	if reply := readReply(t, r); !strings.HasPrefix(reply.GetError(), "NOAUTH") {
+		t.Fatalf("ping returned %v", reply)
+	}
+	want := "ERR Protocol error: frame of 536870912 bytes over the limit for unauthenticated clients"
+	if reply := readReply(t, r); reply.GetError() != want {
+		t.Fatalf("a huge frame header got %v", reply)
+	}
+	expectClosed(t, r)
+
+	// a big frame pipelined after the command that authenticates is served
+	conn = dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r = bufio.NewReader(conn)
+	conn.Write(appendCmd(appendCmd(nil, "auth", "secret"), "set", "k", big))
+	for _, cmd := range []string{"auth", "set"} {
+		if reply := readReply(t, r); reply.GetStatus() != "OK" {
+			t.Fatalf("%s returned %v", cmd, reply)
+		}
+	}
+
+	conn = dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r = bufio.NewReader(conn)
+	conn.Write(appendCmd(appendCmd(nil, "ping"), "set", "k", big))
+	if reply := readReply(t, r); !strings.HasPrefix(reply.GetError(), "NOAUTH") {
+		t.Fatalf("ping returned %v", reply)
+	}
+	if reply := readReply(t, r); !strings.HasSuffix(reply.GetError(), "over the limit for unauthenticated clients") {
+		t.Fatalf("a big frame after ping got %v", reply)
+	}
+	expectClosed(t, r)
+}
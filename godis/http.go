@@ -0,0 +1,320 @@
+package godis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	myProto "godisdb/proto"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	HTTP_MAX_HEADER_LEN int = 64 * 1024
+	HTTP_MAX_BODY_LEN   int = 64 * 1024 * 1024
+)
+
+// httpCommand is the JSON body of a POST to / or /command, args may be
+// strings or numbers.
+type httpCommand struct {
+	Command string        `json:"command"`
+	Args    []interface{} `json:"args"`
+}
+
+// processHttpBuffer runs every complete HTTP request in the query buffer and
+// returns how many bytes were consumed. Requests are read with net/http once
+// their header and body are both in the buffer, a request that can't be read
+// is replied with an error and the connection closed.
+func processHttpBuffer(c *GodisClient) int {
+	pos := 0
+	for pos < len(c.query_buf) && !c.close_after_reply && !c.blocked {
+		end := bytes.Index(c.query_buf[pos:], []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(c.query_buf)-pos > HTTP_MAX_HEADER_LEN {
+				rejectHttpRequest(c, http.StatusRequestHeaderFieldsTooLarge, "ERR request header too large")
+				return len(c.query_buf)
+			}
+			break
+		}
+		header := c.query_buf[pos : pos+end+4]
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+		if err != nil {
+			log.Printf("readClient http error: %v\n", err)
+			rejectHttpRequest(c, http.StatusBadRequest, "ERR malformed HTTP request")
+			return len(c.query_buf)
+		}
+		if req.ContentLength < 0 {
+			rejectHttpRequest(c, http.StatusLengthRequired, "ERR Content-Length is required")
+			return len(c.query_buf)
+		}
+		if req.ContentLength > int64(HTTP_MAX_BODY_LEN) {
+			rejectHttpRequest(c, http.StatusRequestEntityTooLarge, "ERR request body too large")
+			return len(c.query_buf)
+		}
+		expect := req.Header.Get("Expect")
+		if expect != "" && !strings.EqualFold(expect, "100-continue") {
+			rejectHttpRequest(c, http.StatusExpectationFailed, "ERR unsupported expectation")
+			return len(c.query_buf)
+		}
+		length := len(header) + int(req.ContentLength)
+		if len(c.query_buf)-pos < length {
+			// the client waits for it before sending the body
+			if expect != "" && !c.http_continued {
+				c.http_continued = true
+				prepareClientToWrite(c)
+				c.buf = append(c.buf, "HTTP/1.1 100 Continue\r\n\r\n"...)
+			}
+			break
+		}
+		c.http_continued = false
+		body := c.query_buf[pos+len(header) : pos+length]
+		pos += length
+		processHttpRequest(c, req, body)
+	}
+	return pos
+}
+
+// processHttpRequest routes a request, every request authenticates on its
+// own with the Authorization header:
+//
+//	POST / or /command  {"command": "hset", "args": ["h", "f", "v"]}
+//	GET  /command?command=hget&arg=h&arg=f   read commands only
+//	GET  /keys/{key}                          the value of any key
+func processHttpRequest(c *GodisClient, req *http.Request, body []byte) {
+	c.last_interaction = GetMsTime()
+	c.http_close = req.Close
+	c.authenticated = httpAuthenticated(req)
+
+	switch path := req.URL.Path; {
+	case path == "/" || path == "/command":
+		switch req.Method {
+		case http.MethodPost:
+			var cmd httpCommand
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			if err := decoder.Decode(&cmd); err != nil {
+				addHttpError(c, http.StatusBadRequest, "ERR invalid JSON body: "+err.Error())
+				return
+			}
+			args := make([]string, len(cmd.Args))
+			for i, arg := range cmd.Args {
+				switch arg := arg.(type) {
+				case string:
+					args[i] = arg
+				case json.Number:
+					args[i] = arg.String()
+				default:
+					addHttpError(c, http.StatusBadRequest, "ERR args must be strings or numbers")
+					return
+				}
+			}
+			httpRunCommand(c, cmd.Command, args, false)
+		case http.MethodGet:
+			query := req.URL.Query()
+			httpRunCommand(c, query.Get("command"), query["arg"], true)
+		default:
+			addHttpError(c, http.StatusMethodNotAllowed, "ERR method not allowed")
+		}
+	case strings.HasPrefix(path, "/keys/"):
+		if req.Method != http.MethodGet {
+			addHttpError(c, http.StatusMethodNotAllowed, "ERR method not allowed")
+			return
+		}
+		httpKeyCommand(c, strings.TrimPrefix(path, "/keys/"))
+	default:
+		addHttpError(c, http.StatusNotFound, "ERR no such route")
+	}
+}
+
+// httpAuthenticated checks the Authorization header against requirepass,
+// either "Bearer <password>" or basic auth with the "default" user.
+func httpAuthenticated(req *http.Request) bool {
+	if server.requirepass == "" {
+		return true
+	}
+	if user, pass, ok := req.BasicAuth(); ok {
+		return user == "default" && pass == server.requirepass
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && token == server.requirepass
+}
+
+// httpRunCommand runs a command of the command table. GET requests must not
+// change anything, so they are limited to the commands not flagged as
+// writes or pub/sub.
+func httpRunCommand(c *GodisClient, name string, args []string, readonly bool) {
+	if err := checkArgsLimits(args); err != "" {
+		rejectHttpRequest(c, http.StatusRequestEntityTooLarge, "ERR Protocol error: "+err)
+		return
+	}
+	name = strings.ToLower(name)
+	if cmd, ok := CommandTable[name]; ok {
+		if readonly && cmd.mask&(WRITE_COMMAND|PUBSUB_COMMAND) != 0 {
+			addHttpError(c, http.StatusMethodNotAllowed, fmt.Sprintf("ERR '%s' is not a read command, use POST", name))
+			return
+		}
+		if cmd.name == "subscribe" || cmd.name == "unsubscribe" {
+			addHttpError(c, http.StatusBadRequest, fmt.Sprintf("ERR '%s' is not supported over HTTP", name))
+			return
+		}
+	}
+	c.command = name
+	c.arg_count = len(args)
+	c.args = args
+	processClientCommand(c)
+}
+
+// httpKeyCommand replies with the value of a key, read with the command
+// matching its type on the shard owning the key.
+func httpKeyCommand(c *GodisClient, key string) {
+	if !c.authenticated {
+		addReply(c, errorValue(str_err_noauth))
+		return
+	}
+	if routeToShard(c, []string{key}, func(fc *GodisClient) { httpKeyCommand(fc, key) }) {
+		return
+	}
+	checkDel(c, key)
+	obj, ok := c.db.dict[key]
+	if !ok {
+		addReply(c, errorValue(str_err_nokey))
+		return
+	}
+	switch obj.obj_type {
+	case GODIS_LIST:
+		httpRunCommand(c, "lrange", []string{key, "0", "-1"}, true)
+	case GODIS_HASH:
+		httpRunCommand(c, "hgetall", []string{key}, true)
+	case GODIS_SET:
+		httpRunCommand(c, "smembers", []string{key}, true)
+	case GODIS_ZSET:
+		httpRunCommand(c, "zrange", []string{key, "-inf", "+inf", "withscores"}, true)
+	default:
+		httpRunCommand(c, "get", []string{key}, true)
+	}
+}
+
+// rejectHttpRequest replies with an error to a request that can't be
+// served and closes the connection once the reply is sent.
+func rejectHttpRequest(c *GodisClient, status int, err string) {
+	atomic.AddInt64(&server.stat_rejected_requests, 1)
+	c.close_after_reply = true
+	addHttpError(c, status, err)
+}
+
+func addHttpError(c *GodisClient, status int, err string) {
+	if c.close_asap {
+		return
+	}
+	prepareClientToWrite(c)
+	c.buf = appendHttpResponse(c.buf, c, status, map[string]interface{}{"error": err})
+	closeClientOnOutputBufferLimitReached(c)
+}
+
+// appendHttpReply serializes a reply value as an HTTP response, {"result":
+// value} with 200 or {"error": message} with 400, 401 for a missing or wrong
+// password, 404 for a missing key and 503 when maxclients is reached.
+func appendHttpReply(buf []byte, c *GodisClient, v *myProto.Value) []byte {
+	err, ok := v.GetKind().(*myProto.Value_Error)
+	if !ok {
+		return appendHttpResponse(buf, c, http.StatusOK, map[string]interface{}{"result": valueToJson(v)})
+	}
+	status := http.StatusBadRequest
+	if strings.HasPrefix(err.Error, "NOAUTH") || strings.HasPrefix(err.Error, "WRONGPASS") {
+		status = http.StatusUnauthorized
+	} else if err.Error == str_err_nokey {
+		status = http.StatusNotFound
+	} else if err.Error == str_err_maxclients {
+		status = http.StatusServiceUnavailable
+	}
+	return appendHttpResponse(buf, c, status, map[string]interface{}{"error": err.Error})
+}
+
+func appendHttpResponse(buf []byte, c *GodisClient, status int, body interface{}) []byte {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		status = http.StatusInternalServerError
+		payload = []byte(`{"error":"ERR reply can't be encoded as JSON"}`)
+	}
+	payload = append(payload, '\n')
+	buf = fmt.Appendf(buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	buf = append(buf, "Content-Type: application/json\r\n"...)
+	buf = fmt.Appendf(buf, "Content-Length: %d\r\n", len(payload))
+	if status == http.StatusUnauthorized {
+		buf = append(buf, "WWW-Authenticate: Basic realm=\"godis\"\r\n"...)
+	}
+	// a forwarded request is replied after the replies queued before it,
+	// the connection is closed after this one only
+	if c.http_close {
+		c.close_after_reply = true
+	}
+	if c.close_after_reply {
+		buf = append(buf, "Connection: close\r\n"...)
+	}
+	buf = append(buf, "\r\n"...)
+	return append(buf, payload...)
+}
+
+// valueToJson converts a reply value to the value encoding/json marshals.
+// Bulks that aren't valid UTF-8 become {"base64": "..."}, maps whose keys
+// are all strings become objects and other maps arrays of [key, value].
+func valueToJson(v *myProto.Value) interface{} {
+	switch k := v.GetKind().(type) {
+	case *myProto.Value_Integer:
+		return k.Integer
+	case *myProto.Value_Double:
+		if math.IsInf(k.Double, 0) || math.IsNaN(k.Double) {
+			return formatDouble(k.Double)
+		}
+		return k.Double
+	case *myProto.Value_Bulk:
+		if !utf8.Valid(k.Bulk) {
+			return map[string]string{"base64": base64.StdEncoding.EncodeToString(k.Bulk)}
+		}
+		return string(k.Bulk)
+	case *myProto.Value_Status:
+		return k.Status
+	case *myProto.Value_Error:
+		return map[string]string{"error": k.Error}
+	case *myProto.Value_Array:
+		return valuesToJson(k.Array.Values)
+	case *myProto.Value_Set:
+		return valuesToJson(k.Set.Values)
+	case *myProto.Value_Push:
+		return valuesToJson(k.Push.Values)
+	case *myProto.Value_Map:
+		object := make(map[string]interface{}, len(k.Map.Entries))
+		for _, e := range k.Map.Entries {
+			key, ok := valueToJson(e.Key).(string)
+			if !ok {
+				object = nil
+				break
+			}
+			object[key] = valueToJson(e.Value)
+		}
+		if object != nil {
+			return object
+		}
+		pairs := make([]interface{}, len(k.Map.Entries))
+		for i, e := range k.Map.Entries {
+			pairs[i] = []interface{}{valueToJson(e.Key), valueToJson(e.Value)}
+		}
+		return pairs
+	default:
+		return nil
+	}
+}
+
+func valuesToJson(values []*myProto.Value) []interface{} {
+	array := make([]interface{}, len(values))
+	for i, v := range values {
+		array[i] = valueToJson(v)
+	}
+	return array
+}
@@ -0,0 +1,152 @@
+package godis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpDo sends a request to the http port and decodes the JSON response.
+func httpDo(t *testing.T, client *http.Client, method string, path string, body string, password string) (int, map[string]interface{}) {
+	url := "http://" + net.JoinHostPort(server.bindaddr[0], strconv.Itoa(server.http_port)) + path
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest() returned an error: %v", err)
+	}
+	if password != "" {
+		req.Header.Set("Authorization", "Bearer "+password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s returned an error: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the response of %s %s returned an error: %v", method, path, err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("%s %s replied with invalid JSON %q: %v", method, path, data, err)
+	}
+	return resp.StatusCode, result
+}
+
+func TestHttpGateway(t *testing.T) {
+	startTestServer(t, func() {
+		server.http_port = freePort(t)
+	})
+	// a single keep-alive connection serves every request
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 1}}
+	defer client.CloseIdleConnections()
+
+	status, result := httpDo(t, client, "POST", "/command", `{"command": "SET", "args": ["k", 42]}`, "")
+	if status != http.StatusOK || result["result"] != "OK" {
+		t.Fatalf("set replied %d %v", status, result)
+	}
+	status, result = httpDo(t, client, "GET", "/command?command=get&arg=k", "", "")
+	if status != http.StatusOK || result["result"] != "42" {
+		t.Fatalf("get replied %d %v", status, result)
+	}
+	status, result = httpDo(t, client, "GET", "/command?command=set&arg=k&arg=v", "", "")
+	if status != http.StatusMethodNotAllowed || result["error"] == nil {
+		t.Fatalf("set over GET replied %d %v", status, result)
+	}
+
+	httpDo(t, client, "POST", "/", `{"command": "hset", "args": ["h", "f1", "v1", "f2", "v2"]}`, "")
+	status, result = httpDo(t, client, "GET", "/keys/h", "", "")
+	hash, ok := result["result"].(map[string]interface{})
+	if status != http.StatusOK || !ok || hash["f1"] != "v1" || hash["f2"] != "v2" {
+		t.Fatalf("GET /keys/h replied %d %v", status, result)
+	}
+	status, result = httpDo(t, client, "GET", "/keys/missing", "", "")
+	if status != http.StatusNotFound {
+		t.Fatalf("GET /keys/missing replied %d %v", status, result)
+	}
+
+	status, result = httpDo(t, client, "POST", "/command", `{"command": "nosuchcommand"}`, "")
+	if status != http.StatusBadRequest || result["error"] == nil {
+		t.Fatalf("an unknown command replied %d %v", status, result)
+	}
+	status, result = httpDo(t, client, "POST", "/command", `{"command": `, "")
+	if status != http.StatusBadRequest {
+		t.Fatalf("an invalid body replied %d %v", status, result)
+	}
+}
+
+func TestHttpGatewayAuth(t *testing.T) {
+	startTestServer(t, func() {
+		server.http_port = freePort(t)
+		server.requirepass = "secret"
+	})
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	status, _ := httpDo(t, client, "POST", "/command", `{"command": "set", "args": ["k", "v"]}`, "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("an unauthenticated set replied %d", status)
+	}
+	status, _ = httpDo(t, client, "GET", "/keys/k", "", "wrong")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("GET /keys/k with a wrong password replied %d", status)
+	}
+	status, result := httpDo(t, client, "POST", "/command", `{"command": "set", "args": ["k", "v"]}`, "secret")
+	if status != http.StatusOK || result["result"] != "OK" {
+		t.Fatalf("an authenticated set replied %d %v", status, result)
+	}
+	// authentication doesn't carry over to the next request
+	status, _ = httpDo(t, client, "GET", "/keys/k", "", "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("an unauthenticated GET /keys/k replied %d", status)
+	}
+}
+
+func TestHttpGatewayExpectContinue(t *testing.T) {
+	startTestServer(t, func() {
+		server.http_port = freePort(t)
+	})
+	conn := dialTestPort(t, server.http_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	body := `{"command": "set", "args": ["k", "v"]}`
+	fmt.Fprintf(conn, "POST /command HTTP/1.1\r\nHost: godis\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", len(body))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusContinue {
+		t.Fatalf("the request expecting 100-continue got %v, %v", resp, err)
+	}
+	conn.Write([]byte(body))
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("the body got %v, %v", resp, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	fmt.Fprintf(conn, "POST /command HTTP/1.1\r\nHost: godis\r\nExpect: something\r\nContent-Length: %d\r\n\r\n", len(body))
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusExpectationFailed {
+		t.Fatalf("an unknown expectation got %v, %v", resp, err)
+	}
+}
+
+func TestHttpGatewayMaxClients(t *testing.T) {
+	startTestServer(t, func() {
+		server.http_port = freePort(t)
+		server.maxclients = 1
+	})
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(appendCmd(nil, "ping"))
+	readReply(t, bufio.NewReader(conn))
+
+	status, result := httpDo(t, &http.Client{}, "GET", "/keys/k", "", "")
+	if status != http.StatusServiceUnavailable || result["error"] != str_err_maxclients {
+		t.Fatalf("a request over maxclients replied %d %v", status, result)
+	}
+}
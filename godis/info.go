@@ -0,0 +1,146 @@
+package godis
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// genGodisInfoString builds the INFO text of one section, or of all of them
+// for "all" and "default". The clients and memory sections describe the
+// shard s only.
+func genGodisInfoString(s *GodisShard, section string) string {
+	all := section == "all" || section == "default"
+	var b strings.Builder
+	now := GetMsTime()
+
+	if all || section == "server" {
+		fmt.Fprintf(&b, "# Server\r\n")
+		fmt.Fprintf(&b, "godis_version:%s\r\n", GODIS_VERSION)
+		fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&b, "tcp_port:%d\r\n", server.port)
+		fmt.Fprintf(&b, "resp_port:%d\r\n", server.resp_port)
+		fmt.Fprintf(&b, "http_port:%d\r\n", server.http_port)
+		fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", (now-server.stat_starttime)/1000)
+		fmt.Fprintf(&b, "multiplexing_api:%s\r\n", s.loop.AeGetPollerName())
+		fmt.Fprintf(&b, "hz:%d\r\n", server.hz)
+		fmt.Fprintf(&b, "io_threads:%d\r\n", server.io_threads_num)
+		fmt.Fprintf(&b, "shards:%d\r\n", len(server.shards))
+		fmt.Fprintf(&b, "shard_id:%d\r\n", s.id)
+	}
+	if all || section == "clients" {
+		pubsub := 0
+		for _, c := range s.clients {
+			if getClientType(c) == CLIENT_TYPE_PUBSUB {
+				pubsub++
+			}
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# Clients\r\n")
+		fmt.Fprintf(&b, "connected_clients:%d\r\n", atomic.LoadInt64(&server.connected_clients))
+		fmt.Fprintf(&b, "shard_clients:%d\r\n", len(s.clients))
+		fmt.Fprintf(&b, "pubsub_clients:%d\r\n", pubsub)
+		fmt.Fprintf(&b, "maxclients:%d\r\n", server.maxclients)
+	}
+	if all || section == "memory" {
+		var mem [CLIENT_TYPE_COUNT]int
+		maxobuf := 0
+		for _, c := range s.clients {
+			used := getClientOutputBufferMemoryUsage(c)
+			mem[getClientType(c)] += used
+			maxobuf = max(maxobuf, used)
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# Memory\r\n")
+		for i, name := range clientTypeNames {
+			fmt.Fprintf(&b, "mem_clients_%s:%d\r\n", name, mem[i])
+		}
+		fmt.Fprintf(&b, "client_max_output_buffer:%d\r\n", maxobuf)
+	}
+	if all || section == "stats" {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# Stats\r\n")
+		fmt.Fprintf(&b, "total_connections_received:%d\r\n", atomic.LoadInt64(&server.stat_numconnections))
+		fmt.Fprintf(&b, "rejected_connections:%d\r\n", atomic.LoadInt64(&server.stat_rejected_conn))
+		fmt.Fprintf(&b, "client_output_buffer_limit_disconnections:%d\r\n", atomic.LoadInt64(&server.stat_obuf_limit_disconnections))
+		fmt.Fprintf(&b, "compressed_frames_received:%d\r\n", atomic.LoadInt64(&server.stat_compressed_frames_in))
+		fmt.Fprintf(&b, "compressed_frames_sent:%d\r\n", atomic.LoadInt64(&server.stat_compressed_frames_out))
+		fmt.Fprintf(&b, "compression_saved_input_bytes:%d\r\n", atomic.LoadInt64(&server.stat_compression_saved_in))
+		fmt.Fprintf(&b, "compression_saved_output_bytes:%d\r\n", atomic.LoadInt64(&server.stat_compression_saved_out))
+		fmt.Fprintf(&b, "io_threaded_reads_processed:%d\r\n", server.stat_io_reads_processed)
+		fmt.Fprintf(&b, "io_threaded_writes_processed:%d\r\n", server.stat_io_writes_processed)
+		fmt.Fprintf(&b, "forwarded_commands:%d\r\n", atomic.LoadInt64(&server.stat_forwarded_commands))
+		fmt.Fprintf(&b, "streamed_replies:%d\r\n", atomic.LoadInt64(&server.stat_streamed_replies))
+		fmt.Fprintf(&b, "rejected_requests:%d\r\n", atomic.LoadInt64(&server.stat_rejected_requests))
+		fmt.Fprintf(&b, "client_query_buffer_limit_disconnections:%d\r\n", atomic.LoadInt64(&server.stat_qbuf_limit_disconnections))
+	}
+	return b.String()
+}
+
+func infoCommand(c *GodisClient) {
+	if err := checkArgsCount(c); err != nil {
+		return
+	}
+	if c.arg_count > 1 {
+		genReply(c, RE_ERR, &str_err_syntax, 0, nil)
+		return
+	}
+	section := "default"
+	if c.arg_count == 1 {
+		section = strings.ToLower(c.args[0])
+	}
+	s := genGodisInfoString(c.shard, section)
+	genReply(c, RE_STRING, &s, 0, nil)
+}
+
+// catClientInfoString describes a client the way CLIENT LIST does.
+func catClientInfoString(c *GodisClient) string {
+	now := GetMsTime()
+	omem := getClientOutputBufferMemoryUsage(c)
+	return fmt.Sprintf("id=%d addr=%s fd=%d name=%s age=%d idle=%d sub=%d qbuf=%d omem=%d tot-mem=%d resp=%d",
+		c.fd, c.addr, c.fd, c.name, (now-c.ctime)/1000, (now-c.last_interaction)/1000,
+		len(c.pubsub_channels), len(c.query_buf), omem, cap(c.query_buf)+cap(c.buf), c.resp)
+}
+
+// clientCommand implements CLIENT LIST|ID|GETNAME|SETNAME
+func clientCommand(c *GodisClient) {
+	if err := checkArgsCount(c); err != nil {
+		return
+	}
+	switch sub := strings.ToLower(c.args[0]); {
+	case sub == "list" && c.arg_count == 1:
+		var b strings.Builder
+		for _, client := range c.shard.clients {
+			b.WriteString(catClientInfoString(client))
+			b.WriteString("\n")
+		}
+		s := b.String()
+		genReply(c, RE_STRING, &s, 0, nil)
+	case sub == "id" && c.arg_count == 1:
+		genReply(c, RE_INT, nil, c.fd, nil)
+	case sub == "getname" && c.arg_count == 1:
+		if c.name == "" {
+			genReply(c, RE_NONE, nil, 0, nil)
+		} else {
+			genReply(c, RE_STRING, &c.name, 0, nil)
+		}
+	case sub == "setname" && c.arg_count == 2:
+		if strings.ContainsAny(c.args[1], " \n") {
+			s := "ERR Client names cannot contain spaces, newlines or special characters."
+			genReply(c, RE_ERR, &s, 0, nil)
+			return
+		}
+		c.name = c.args[1]
+		genReply(c, RE_OK, &str_ok, 0, nil)
+	default:
+		s := fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", c.args[0])
+		genReply(c, RE_ERR, &s, 0, nil)
+	}
+}
@@ -0,0 +1,85 @@
+package godis
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckClientOutputBufferLimits(t *testing.T) {
+	initServerConfig()
+	server.client_obuf_limits[CLIENT_TYPE_NORMAL] = ClientBufferLimit{1000, 100, 1}
+	c := &GodisClient{pubsub_channels: map[string]bool{}}
+
+	c.buf = make([]byte, 150)
+	if checkClientOutputBufferLimits(c) {
+		t.Error("a client just over the soft limit was closed")
+	}
+	if c.obuf_soft_limit_reached_time == 0 {
+		t.Fatal("the time the soft limit was reached was not recorded")
+	}
+	c.obuf_soft_limit_reached_time -= 2000
+	if !checkClientOutputBufferLimits(c) {
+		t.Error("a client over the soft limit for too long was not closed")
+	}
+
+	c.buf = make([]byte, 50)
+	if checkClientOutputBufferLimits(c) || c.obuf_soft_limit_reached_time != 0 {
+		t.Error("a client back under the soft limit was not reset")
+	}
+	c.buf = make([]byte, 1000)
+	if !checkClientOutputBufferLimits(c) {
+		t.Error("a client over the hard limit was not closed")
+	}
+	c.pubsub_channels["news"] = true
+	if checkClientOutputBufferLimits(c) {
+		t.Error("the normal class limits were applied to a pubsub client")
+	}
+}
+
+func TestPubsubOutputBufferLimit(t *testing.T) {
+	startTestServer(t, func() {
+		server.client_obuf_limits[CLIENT_TYPE_PUBSUB] = ClientBufferLimit{1 << 20, 0, 0}
+	})
+	sub := dialTestPort(t, server.resp_port)
+	sub.SetDeadline(time.Now().Add(10 * time.Second))
+	sub.Write([]byte("subscribe news\r\n"))
+	subr := bufio.NewReader(sub)
+	if line, _ := subr.ReadString('\n'); line != "*3\r\n" {
+		t.Fatalf("subscribe returned %q", line)
+	}
+
+	pub := dialTestPort(t, server.resp_port)
+	pub.SetDeadline(time.Now().Add(10 * time.Second))
+	pubr := bufio.NewReader(pub)
+	msg := strings.Repeat("m", 60*1024)
+	go func() {
+		for i := 0; i < 512; i++ {
+			pub.Write([]byte("publish news " + msg + "\r\n"))
+		}
+	}()
+	for i := 0; i < 512; i++ {
+		if _, err := pubr.ReadString('\n'); err != nil {
+			t.Fatalf("publish returned an error: %v", err)
+		}
+	}
+
+	// the subscriber gets what was flushed before it was dropped, then EOF
+	if _, err := io.Copy(io.Discard, subr); err != nil {
+		t.Fatalf("the subscriber was not disconnected: %v", err)
+	}
+	pub.Write([]byte("info stats\r\n"))
+	header, err := pubr.ReadString('\n')
+	if err != nil {
+		t.Fatalf("info returned an error: %v", err)
+	}
+	size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+	info := make([]byte, size)
+	io.ReadFull(pubr, info)
+	if !strings.Contains(string(info), "client_output_buffer_limit_disconnections:1\r\n") {
+		t.Errorf("info stats returned %q %q", header, info)
+	}
+}
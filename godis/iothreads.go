@@ -0,0 +1,212 @@
+package godis
+
+import (
+	"log"
+	"sync"
+)
+
+// Threaded I/O works like Redis 6 io-threads, for servers running a single
+// shard. Readable clients are queued
+// by readClient and writes by addReply, then beforeSleep splits the queued
+// clients between the IO threads and the main loop, which all read and
+// decode or serialize and write their share in parallel. The main loop waits
+// for every thread to finish before it runs the decoded commands or touches
+// the clients again, so commands and the keyspace stay single threaded and
+// an IO thread never touches anything but the clients it was given.
+
+const IO_THREADS_MAX_NUM int = 128
+
+// ioThread is an IO thread, it runs each job it receives on its clients.
+type ioThread struct {
+	clients []*GodisClient
+	jobs    chan func(c *GodisClient)
+	done    *sync.WaitGroup
+}
+
+func (t *ioThread) run() {
+	for job := range t.jobs {
+		for _, c := range t.clients {
+			job(c)
+		}
+		t.done.Done()
+	}
+}
+
+// initThreadedIO starts the IO threads, the main loop counts as one of the
+// io_threads_num threads.
+func initThreadedIO() {
+	server.io_threads = nil
+	for i := 1; i < server.io_threads_num; i++ {
+		t := &ioThread{
+			jobs: make(chan func(c *GodisClient)),
+			done: &server.io_threads_wg,
+		}
+		server.io_threads = append(server.io_threads, t)
+		go t.run()
+	}
+}
+
+func killThreadedIO() {
+	for _, t := range server.io_threads {
+		close(t.jobs)
+	}
+	server.io_threads = nil
+}
+
+// runIOThreads runs job on every client, split between the IO threads and
+// the main loop, and returns once all of them are done. Too few clients to
+// be worth waking the threads are handled by the main loop alone.
+func runIOThreads(clients []*GodisClient, job func(c *GodisClient)) {
+	if len(clients) < 2*server.io_threads_num {
+		for _, c := range clients {
+			job(c)
+		}
+		return
+	}
+	for _, t := range server.io_threads {
+		t.clients = t.clients[:0]
+	}
+	n := len(server.io_threads) + 1
+	var own []*GodisClient
+	for i, c := range clients {
+		if i%n == 0 {
+			own = append(own, c)
+		} else {
+			t := server.io_threads[i%n-1]
+			t.clients = append(t.clients, c)
+		}
+	}
+	server.io_threads_wg.Add(len(server.io_threads))
+	for _, t := range server.io_threads {
+		t.jobs <- job
+	}
+	for _, c := range own {
+		job(c)
+	}
+	server.io_threads_wg.Wait()
+}
+
+// takeLiveClients empties a pending queue and returns the clients in it
+// that weren't freed since they were queued.
+func takeLiveClients(queue *[]*GodisClient) []*GodisClient {
+	clients := (*queue)[:0:0]
+	for _, c := range *queue {
+		if c.shard.clients[c.fd] == c {
+			clients = append(clients, c)
+		}
+	}
+	*queue = (*queue)[:0]
+	return clients
+}
+
+// postponeClientRead queues a readable client for the IO threads, returns
+// false if the client has to be read right away.
+func postponeClientRead(c *GodisClient) bool {
+	if server.io_threads_num <= 1 || !server.io_threads_do_reads {
+		return false
+	}
+	if !c.pending_read {
+		c.pending_read = true
+		server.clients_pending_read = append(server.clients_pending_read, c)
+	}
+	return true
+}
+
+// clientUsesThreadedWrites reports whether the replies of the client are
+// serialized and written by the IO threads. TLS clients are served by the
+// main loop, and HTTP replies are serialized right away since their headers
+// depend on the request being replied to.
+func clientUsesThreadedWrites(c *GodisClient) bool {
+	return server.io_threads_num > 1 && c.tls == nil && c.proto != PROTO_HTTP
+}
+
+// readAndParseClient is the read job of the IO threads. RESP and HTTP
+// requests are parsed by the main loop, protobuf frames are decoded here.
+func readAndParseClient(c *GodisClient) {
+	if err := readQueryFromClient(c); err != nil {
+		c.io_err = err
+		return
+	}
+	if c.proto == PROTO_PROTOBUF && !c.close_after_reply {
+		compactQueryBuffer(c, parseProtobufBuffer(c))
+	}
+}
+
+// serializeAndWriteClient is the write job of the IO threads.
+func serializeAndWriteClient(c *GodisClient) {
+	for _, v := range c.pending_values {
+		buf, err := appendReply(c.buf, c, v)
+		if err != nil {
+			log.Printf("addReply proto error: %v\n", err)
+			continue
+		}
+		c.buf = buf
+	}
+	c.pending_values = nil
+	c.pending_values_len = 0
+	if err := writeToClient(c); err != nil {
+		c.io_err = err
+	}
+}
+
+// handleClientsWithPendingReadsUsingThreads reads the queued clients in
+// parallel, then runs the commands they sent.
+func handleClientsWithPendingReadsUsingThreads() {
+	if len(server.clients_pending_read) == 0 {
+		return
+	}
+	clients := takeLiveClients(&server.clients_pending_read)
+	runIOThreads(clients, readAndParseClient)
+	if len(clients) >= 2*server.io_threads_num {
+		server.stat_io_reads_processed += len(clients)
+	}
+	for _, c := range clients {
+		c.pending_read = false
+		if c.shard.clients[c.fd] != c {
+			continue
+		}
+		if c.io_err != nil {
+			freeClientOnReadError(c, c.io_err)
+			continue
+		}
+		processInputBuffer(c)
+	}
+	freeClientsInAsyncFreeQueue(server.shards[0])
+}
+
+// handleClientsWithPendingWritesUsingThreads serializes and writes the
+// queued replies in parallel. The write handler is installed for the
+// clients whose socket didn't take everything.
+func handleClientsWithPendingWritesUsingThreads() {
+	if len(server.clients_pending_write) == 0 {
+		return
+	}
+	clients := takeLiveClients(&server.clients_pending_write)
+	runIOThreads(clients, serializeAndWriteClient)
+	if len(clients) >= 2*server.io_threads_num {
+		server.stat_io_writes_processed += len(clients)
+	}
+	for _, c := range clients {
+		c.pending_write = false
+		if c.shard.clients[c.fd] != c {
+			continue
+		}
+		if c.io_err != nil {
+			log.Printf("replyToClient Write error: %v\n", c.io_err)
+			freeClient(c)
+			continue
+		}
+		if c.sentlen < len(c.buf) {
+			if c.shard.loop.AeGetFileEvents(c.fd)&AE_WRITABLE == 0 {
+				c.shard.loop.AeCreateFileEvent(c.fd, AE_WRITABLE, replyToClient, nil)
+			}
+			closeClientOnOutputBufferLimitReached(c)
+			continue
+		}
+		if c.close_after_reply {
+			freeClient(c)
+			continue
+		}
+		resetOutputBuffer(c)
+	}
+}
@@ -0,0 +1,195 @@
+package godis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIOThreads(t *testing.T) {
+	startTestServer(t, func() {
+		server.io_threads_num = 4
+	})
+
+	const clients = 32
+	const commands = 100
+	conns := make([]net.Conn, clients)
+	for i := range conns {
+		conns[i] = dialTestServer(t)
+		conns[i].SetDeadline(time.Now().Add(10 * time.Second))
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	// the pipelines span many reads, so that plenty of clients are readable
+	// at the same time and the threads get to share them
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := bufio.NewReader(conn)
+			var buf []byte
+			for j := 0; j < commands; j++ {
+				key := fmt.Sprintf("key:%d:%d", i, j)
+				buf = appendCmd(buf, "set", key, strings.Repeat("v", 100*j))
+				buf = appendCmd(buf, "get", key)
+			}
+			if _, err := conn.Write(buf); err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < commands; j++ {
+				if reply := readReply(t, r); reply.GetStatus() != "OK" {
+					errs <- fmt.Errorf("client %d: set %d returned %v", i, j, reply)
+					return
+				}
+				if reply := readReply(t, r); string(reply.GetBulk()) != strings.Repeat("v", 100*j) {
+					errs <- fmt.Errorf("client %d: get %d returned %v", i, j, reply)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// RESP clients are read by the threads too
+	resp := dialTestPort(t, server.resp_port)
+	resp.SetDeadline(time.Now().Add(5 * time.Second))
+	respRoundTrip(t, resp, bufio.NewReader(resp), "GET key:3:0\r\n", "$0\r\n\r\n")
+
+	conn := conns[0]
+	r := bufio.NewReader(conn)
+	conn.Write(appendCmd(nil, "info", "stats"))
+	info := string(readReply(t, r).GetBulk())
+	if strings.Contains(info, "io_threaded_reads_processed:0\r\n") ||
+		strings.Contains(info, "io_threaded_writes_processed:0\r\n") {
+		t.Fatalf("the IO threads didn't process any client:\n%s", info)
+	}
+}
+
+// BenchmarkIOThreads runs many clients pipelining GETs of 4KB values, with
+// and without IO threads. The speedup needs as many cores as threads:
+//
+//	go test ./godis -run XXX -bench IOThreads
+func BenchmarkIOThreads(b *testing.B) {
+	// every command is logged, which would be all the benchmark measures
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, threads := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("io-threads=%d", threads), func(b *testing.B) {
+			startTestServer(b, func() {
+				server.io_threads_num = threads
+			})
+			benchmarkPipelinedGets(b)
+		})
+	}
+}
+
+func benchmarkPipelinedGets(b *testing.B) {
+	const clients = 64
+	const pipeline = 32
+	value := strings.Repeat("v", 4096)
+	addr := net.JoinHostPort(server.bindaddr[0], strconv.Itoa(server.port))
+	setup, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer setup.Close()
+	setup.Write(appendCmd(nil, "set", "key", value))
+	bufio.NewReader(setup).ReadByte()
+
+	var req []byte
+	for i := 0; i < pipeline; i++ {
+		req = appendCmd(req, "get", "key")
+	}
+	b.SetBytes(int64(pipeline * len(value)))
+	b.ResetTimer()
+	var next sync.Mutex
+	remaining := b.N
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := bufio.NewReaderSize(conn, 64*1024)
+			for {
+				next.Lock()
+				if remaining == 0 {
+					next.Unlock()
+					return
+				}
+				remaining--
+				next.Unlock()
+				if _, err := conn.Write(req); err != nil {
+					return
+				}
+				for j := 0; j < pipeline; j++ {
+					if _, err := readFrame(r); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// readFrame skips one length-prefixed reply without decoding it.
+func readFrame(r *bufio.Reader) (int, error) {
+	var size uint64
+	for shift := 0; ; shift += 7 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		size |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			break
+		}
+	}
+	n, err := r.Discard(int(size))
+	return n, err
+}
+
+func TestIOThreadsOutputBufferLimit(t *testing.T) {
+	startTestServer(t, func() {
+		server.io_threads_num = 4
+		server.client_obuf_limits[CLIENT_TYPE_NORMAL] = ClientBufferLimit{256 * 1024, 0, 0}
+	})
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write(appendCmd(nil, "set", "big", strings.Repeat("x", 64*1024)))
+	readReply(t, r)
+
+	// the replies left for the threads count toward the limit, the client
+	// is closed before they are written
+	var buf []byte
+	for i := 0; i < 50; i++ {
+		buf = appendCmd(buf, "get", "big")
+	}
+	conn.Write(buf)
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatalf("reading the replies returned an error: %v", err)
+	}
+	if n >= 256*1024 {
+		t.Fatalf("got %d bytes of replies over the output buffer limit", n)
+	}
+}
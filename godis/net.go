@@ -1,15 +1,27 @@
 package godis
 
 import (
+	"fmt"
 	"net"
+	"os"
 
 	"golang.org/x/sys/unix"
 )
 
 const BACKLOG int = 511
 
+// TcpSocket listens on an IPv4 or IPv6 address. IPv6 sockets are made
+// v6 only so that "::" and "0.0.0.0" can be bound side by side.
 func TcpSocket(ipAddr string, port int) (int, error) {
-	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return -1, fmt.Errorf("invalid bind address '%s'", ipAddr)
+	}
+	family := unix.AF_INET6
+	if ip.To4() != nil {
+		family = unix.AF_INET
+	}
+	fd, err := unix.Socket(family, unix.SOCK_STREAM, unix.IPPROTO_TCP)
 	if err != nil {
 		return -1, err
 	}
@@ -19,16 +31,64 @@ func TcpSocket(ipAddr string, port int) (int, error) {
 		return -1, err
 	}
 
-	var addr [4]byte
-	copy(addr[:], net.ParseIP(ipAddr).To4())
-	err = unix.Bind(fd, &unix.SockaddrInet4{
-		Addr: addr,
-		Port: port,
-	})
+	var sa unix.Sockaddr
+	if family == unix.AF_INET {
+		var addr [4]byte
+		copy(addr[:], ip.To4())
+		sa = &unix.SockaddrInet4{
+			Addr: addr,
+			Port: port,
+		}
+	} else {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)
+		if err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+		var addr [16]byte
+		copy(addr[:], ip.To16())
+		sa = &unix.SockaddrInet6{
+			Addr: addr,
+			Port: port,
+		}
+	}
+	err = unix.Bind(fd, sa)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	err = unix.Listen(fd, BACKLOG)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// UnixSocket listens on a unix domain socket at path, a stale socket file left
+// by a previous run is removed first. A non zero perm is applied to the file.
+func UnixSocket(path string, perm uint32) (int, error) {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		unix.Close(fd)
+		return -1, err
+	}
+	err = unix.Bind(fd, &unix.SockaddrUnix{Name: path})
 	if err != nil {
 		unix.Close(fd)
 		return -1, err
 	}
+	if perm != 0 {
+		err = unix.Chmod(path, perm)
+		if err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+	}
 	err = unix.Listen(fd, BACKLOG)
 	if err != nil {
 		unix.Close(fd)
@@ -36,3 +96,46 @@ func TcpSocket(ipAddr string, port int) (int, error) {
 	}
 	return fd, nil
 }
+
+func sockaddrToAddr(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}
+	case *unix.SockaddrInet6:
+		return &net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}
+	case *unix.SockaddrUnix:
+		return &net.UnixAddr{Name: sa.Name, Net: "unix"}
+	}
+	return &net.TCPAddr{}
+}
+
+// peerAddr formats the address of the peer connected to fd as ip:port.
+func peerAddr(fd int) string {
+	sa, err := unix.Getpeername(fd)
+	if err != nil {
+		return "?:0"
+	}
+	if _, ok := sa.(*unix.SockaddrUnix); ok {
+		return server.unixsocket + ":0"
+	}
+	return sockaddrToAddr(sa).String()
+}
+
+// KeepAlive enables TCP keepalive on fd. The first probe is sent after
+// interval seconds of idle time, then every interval/3 seconds, and the
+// connection is dropped after 3 unanswered probes.
+func KeepAlive(fd int, interval int) error {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1)
+	if err != nil {
+		return err
+	}
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, interval)
+	if err != nil {
+		return err
+	}
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, max(interval/3, 1))
+	if err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3)
+}
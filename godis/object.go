@@ -14,8 +14,10 @@ const (
 type GodisVal interface{}
 
 type GodisObj struct {
-	obj_type GodisType
-	val      GodisVal
+	obj_type  GodisType
+	val       GodisVal
+	streams   int // replies streaming the object, commands copy it before changing it
+	snapshots int // atomic batches that may restore the object, commands copy it before changing it
 }
 
 type GodisHash map[string]*GodisObj
@@ -65,3 +67,36 @@ func CompareStrObj(a *GodisObj, b *GodisObj) bool {
 	}
 	return false
 }
+
+// dupObject returns a deep copy of the object, changes made to the copy are
+// not seen through the original.
+func dupObject(o *GodisObj) *GodisObj {
+	dup := CreateObj(o.obj_type, o.val)
+	switch val := o.val.(type) {
+	case GodisHash:
+		hash := dup.val.(GodisHash)
+		for k, v := range val {
+			hash[k] = dupObject(v)
+		}
+	case *GodisList:
+		list := dup.val.(*GodisList)
+		for node := val.listFirst(); node != nil; node = val.listNextNode(node) {
+			list.listAddNodeTail(dupObject(node.val))
+		}
+	case GodisSet:
+		set := dup.val.(GodisSet)
+		for k, v := range val {
+			if v != nil {
+				v = dupObject(v)
+			}
+			set[k] = v
+		}
+	case *GodisZset:
+		zset := dup.val.(*GodisZset)
+		for member, score := range val.dict {
+			zset.dict[member] = score
+			zset.zskiplist.spInsert(score, CreateObj(GODIS_STRING, member))
+		}
+	}
+	return dup
+}
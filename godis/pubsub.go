@@ -0,0 +1,93 @@
+package godis
+
+import myProto "godisdb/proto"
+
+// addPushReply queues an out of band message of the given kind about
+// channel, RESP3 sends it as a push frame and RESP2 as a plain array.
+func addPushReply(c *GodisClient, kind string, channel string, v *myProto.Value) {
+	addReply(c, pushValue(bulkValue(kind), bulkValue(channel), v))
+}
+
+func pubsubSubscribeChannel(c *GodisClient, channel string) {
+	if !c.pubsub_channels[channel] {
+		c.pubsub_channels[channel] = true
+		if _, ok := c.shard.pubsub_channels[channel]; !ok {
+			c.shard.pubsub_channels[channel] = make(map[int]*GodisClient)
+		}
+		c.shard.pubsub_channels[channel][c.fd] = c
+	}
+	addPushReply(c, "subscribe", channel, integerValue(int64(len(c.pubsub_channels))))
+}
+
+func pubsubUnsubscribeChannel(c *GodisClient, channel string, notify bool) {
+	if c.pubsub_channels[channel] {
+		delete(c.pubsub_channels, channel)
+		delete(c.shard.pubsub_channels[channel], c.fd)
+		if len(c.shard.pubsub_channels[channel]) == 0 {
+			delete(c.shard.pubsub_channels, channel)
+		}
+	}
+	if notify {
+		addPushReply(c, "unsubscribe", channel, integerValue(int64(len(c.pubsub_channels))))
+	}
+}
+
+// pubsubUnsubscribeAllChannels drops every subscription of the client and
+// returns how many channels it was subscribed to.
+func pubsubUnsubscribeAllChannels(c *GodisClient, notify bool) int {
+	count := len(c.pubsub_channels)
+	for channel := range c.pubsub_channels {
+		pubsubUnsubscribeChannel(c, channel, notify)
+	}
+	return count
+}
+
+// pubsubPublishMessage sends the message to the subscribers the shard holds.
+func pubsubPublishMessage(s *GodisShard, channel string, message string) int {
+	receivers := 0
+	for _, c := range s.pubsub_channels[channel] {
+		addPushReply(c, "message", channel, bulkValue(message))
+		receivers++
+	}
+	return receivers
+}
+
+func subscribeCommand(c *GodisClient) {
+	if err := checkArgsCount(c); err != nil {
+		return
+	}
+	for _, channel := range c.args {
+		pubsubSubscribeChannel(c, channel)
+	}
+}
+
+func unsubscribeCommand(c *GodisClient) {
+	if err := checkArgsCount(c); err != nil {
+		return
+	}
+	if c.arg_count == 0 {
+		if pubsubUnsubscribeAllChannels(c, true) == 0 {
+			addReply(c, pushValue(bulkValue("unsubscribe"), nullValue(), integerValue(0)))
+		}
+		return
+	}
+	for _, channel := range c.args {
+		pubsubUnsubscribeChannel(c, channel, true)
+	}
+}
+
+// publishCommand replies with the receivers of the shard the client is
+// served by, the other shards get the message a bit later.
+func publishCommand(c *GodisClient) {
+	if err := checkArgsCount(c); err != nil {
+		return
+	}
+	channel, message := c.args[0], c.args[1]
+	receivers := pubsubPublishMessage(c.shard, channel, message)
+	for _, s := range server.shards {
+		if s != c.shard {
+			s.loop.AePost(func() { pubsubPublishMessage(s, channel, message) })
+		}
+	}
+	genReply(c, RE_INT, nil, receivers, nil)
+}
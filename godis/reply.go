@@ -0,0 +1,145 @@
+package godis
+
+import (
+	myProto "godisdb/proto"
+	"math"
+	"strconv"
+)
+
+// Reply values are built with the constructors below and queued with
+// addReply, the wire format of the client is picked when they are serialized.
+
+func nullValue() *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Null{Null: &myProto.Null{}}}
+}
+
+func integerValue(n int64) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Integer{Integer: n}}
+}
+
+func doubleValue(f float64) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Double{Double: f}}
+}
+
+func bulkValue(s string) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Bulk{Bulk: []byte(s)}}
+}
+
+func statusValue(s string) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Status{Status: s}}
+}
+
+func errorValue(s string) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Error{Error: s}}
+}
+
+func arrayValue(values ...*myProto.Value) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Array{Array: &myProto.Array{Values: values}}}
+}
+
+func setValue(values ...*myProto.Value) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Set{Set: &myProto.Array{Values: values}}}
+}
+
+func pushValue(values ...*myProto.Value) *myProto.Value {
+	return &myProto.Value{Kind: &myProto.Value_Push{Push: &myProto.Array{Values: values}}}
+}
+
+// mapValue builds a map out of alternating keys and values.
+func mapValue(kv ...*myProto.Value) *myProto.Value {
+	entries := make([]*myProto.Entry, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		entries = append(entries, &myProto.Entry{Key: kv[i], Value: kv[i+1]})
+	}
+	return &myProto.Value{Kind: &myProto.Value_Map{Map: &myProto.Map{Entries: entries}}}
+}
+
+func bulkValues(slice []string) []*myProto.Value {
+	values := make([]*myProto.Value, len(slice))
+	for i, s := range slice {
+		values[i] = bulkValue(s)
+	}
+	return values
+}
+
+// formatDouble formats a double the way RESP does, with the shortest
+// representation that parses back to the same value.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// legacyReply flattens a value into the args and reply_type understood by
+// clients older than protocol version 2. Nested values are flattened in
+// order and nulls inside aggregates become empty strings.
+func legacyReply(v *myProto.Value) *myProto.Reply {
+	var re_type ReplyType
+	switch v.Kind.(type) {
+	case *myProto.Value_Null:
+		return &myProto.Reply{ReplyType: int64(RE_NONE)}
+	case *myProto.Value_Integer:
+		re_type = RE_INT
+	case *myProto.Value_Double:
+		re_type = RE_FLOAT
+	case *myProto.Value_Bulk:
+		re_type = RE_STRING
+	case *myProto.Value_Status:
+		re_type = RE_OK
+	case *myProto.Value_Error:
+		re_type = RE_ERR
+	case *myProto.Value_Map:
+		re_type = RE_HASH
+	case *myProto.Value_Set:
+		re_type = RE_SET
+	case *myProto.Value_Push:
+		re_type = RE_PUSH
+	default:
+		re_type = RE_LIST
+	}
+	return &myProto.Reply{
+		Args:      flattenValue(nil, v),
+		ReplyType: int64(re_type),
+	}
+}
+
+func flattenValue(args [][]byte, v *myProto.Value) [][]byte {
+	switch k := v.Kind.(type) {
+	case *myProto.Value_Null:
+		args = append(args, []byte{})
+	case *myProto.Value_Integer:
+		args = append(args, strconv.AppendInt(nil, k.Integer, 10))
+	case *myProto.Value_Double:
+		args = append(args, []byte(formatDouble(k.Double)))
+	case *myProto.Value_Bulk:
+		args = append(args, k.Bulk)
+	case *myProto.Value_Status:
+		args = append(args, []byte(k.Status))
+	case *myProto.Value_Error:
+		args = append(args, []byte(k.Error))
+	case *myProto.Value_Map:
+		for _, e := range k.Map.Entries {
+			args = flattenValue(args, e.Key)
+			args = flattenValue(args, e.Value)
+		}
+	case *myProto.Value_Array:
+		for _, e := range k.Array.Values {
+			args = flattenValue(args, e)
+		}
+	case *myProto.Value_Set:
+		for _, e := range k.Set.Values {
+			args = flattenValue(args, e)
+		}
+	case *myProto.Value_Push:
+		for _, e := range k.Push.Values {
+			args = flattenValue(args, e)
+		}
+	}
+	return args
+}
@@ -0,0 +1,205 @@
+package godis
+
+import (
+	"bytes"
+	"errors"
+	myProto "godisdb/proto"
+	"strconv"
+	"strings"
+)
+
+const RESP_MAX_INLINE_LEN int = 64 * 1024
+
+// parseRespLine returns the line starting at pos without its CRLF and the
+// position right after it, or -1 if the line is not complete yet.
+func parseRespLine(buf []byte, pos int) ([]byte, int) {
+	idx := bytes.Index(buf[pos:], []byte("\r\n"))
+	if idx < 0 {
+		return nil, -1
+	}
+	return buf[pos : pos+idx], pos + idx + 2
+}
+
+// RESP_MAX_ARGS_PREALLOC bounds the arguments allocated up front for a
+// multibulk request, the count it announces may be a lie.
+const RESP_MAX_ARGS_PREALLOC int = 1024
+
+// respParser is the state of a multibulk request that spans several reads.
+// The count and the arguments already read are consumed from the query
+// buffer, so a request arriving in pieces isn't parsed again from its start.
+type respParser struct {
+	multibulklen int      // arguments left to read, 0 between requests
+	bulklen      int      // length of the argument being read, -1 until its header is read
+	args         []string // arguments read so far
+}
+
+// parse parses a request in either the multibulk or the inline format. It
+// returns the bytes consumed and, once the request is complete, done and its
+// arguments. A request of more than maxArgs arguments, the command
+// included, or with an argument longer than maxBulkLen is a protocol error.
+func (p *respParser) parse(buf []byte, maxArgs int, maxBulkLen int) (args []string, n int, done bool, err error) {
+	pos := 0
+	if p.multibulklen == 0 {
+		if len(buf) == 0 {
+			return nil, 0, false, nil
+		}
+		if buf[0] != '*' {
+			args, n, err := parseRespInline(buf)
+			return args, n, n > 0, err
+		}
+		line, next := parseRespLine(buf, 0)
+		if next < 0 {
+			if len(buf) > RESP_MAX_INLINE_LEN {
+				return nil, 0, false, errors.New("Protocol error: too big mbulk count string")
+			}
+			return nil, 0, false, nil
+		}
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count > maxArgs {
+			return nil, 0, false, errors.New("Protocol error: invalid multibulk length")
+		}
+		if count <= 0 {
+			return []string{}, next, true, nil
+		}
+		p.multibulklen = count
+		p.bulklen = -1
+		p.args = make([]string, 0, min(count, RESP_MAX_ARGS_PREALLOC))
+		pos = next
+	}
+	for p.multibulklen > 0 {
+		if p.bulklen == -1 {
+			line, next := parseRespLine(buf, pos)
+			if next < 0 {
+				if len(buf)-pos > RESP_MAX_INLINE_LEN {
+					return nil, 0, false, errors.New("Protocol error: too big bulk count string")
+				}
+				return nil, pos, false, nil
+			}
+			if len(line) == 0 || line[0] != '$' {
+				return nil, 0, false, errors.New("Protocol error: expected '$', got '" + string(line[:min(len(line), 1)]) + "'")
+			}
+			size, err := strconv.Atoi(string(line[1:]))
+			if err != nil || size < 0 || size > maxBulkLen {
+				return nil, 0, false, errors.New("Protocol error: invalid bulk length")
+			}
+			p.bulklen = size
+			pos = next
+		}
+		if len(buf)-pos < p.bulklen+2 {
+			return nil, pos, false, nil
+		}
+		if buf[pos+p.bulklen] != '\r' || buf[pos+p.bulklen+1] != '\n' {
+			return nil, 0, false, errors.New("Protocol error: invalid bulk terminator")
+		}
+		p.args = append(p.args, string(buf[pos:pos+p.bulklen]))
+		pos += p.bulklen + 2
+		p.bulklen = -1
+		p.multibulklen--
+	}
+	args = p.args
+	p.args = nil
+	return args, pos, true, nil
+}
+
+func parseRespInline(buf []byte) ([]string, int, error) {
+	idx := bytes.IndexByte(buf, '\n')
+	if idx < 0 {
+		if len(buf) > RESP_MAX_INLINE_LEN {
+			return nil, 0, errors.New("Protocol error: too big inline request")
+		}
+		return nil, 0, nil
+	}
+	line := strings.TrimSuffix(string(buf[:idx]), "\r")
+	return strings.Fields(line), idx + 1, nil
+}
+
+func appendRespBulk(buf []byte, s []byte) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, s...)
+	return append(buf, "\r\n"...)
+}
+
+func appendRespAggregate(buf []byte, prefix byte, count int) []byte {
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(count), 10)
+	return append(buf, "\r\n"...)
+}
+
+// appendRespLine serializes a single line reply. Status and error lines may
+// quote what a client sent, newlines are replaced by spaces so that they
+// can't end the line early.
+func appendRespLine(buf []byte, prefix byte, s string) []byte {
+	buf = append(buf, prefix)
+	start := len(buf)
+	buf = append(buf, s...)
+	if prefix == '+' || prefix == '-' {
+		for i := start; i < len(buf); i++ {
+			if buf[i] == '\r' || buf[i] == '\n' {
+				buf[i] = ' '
+			}
+		}
+	}
+	return append(buf, "\r\n"...)
+}
+
+// appendRespValue serializes a reply value in the given RESP version. RESP2
+// folds maps, sets and pushes into arrays and sends doubles as bulks.
+func appendRespValue(buf []byte, v *myProto.Value, resp int) []byte {
+	switch k := v.Kind.(type) {
+	case *myProto.Value_Null:
+		if resp == 3 {
+			buf = append(buf, "_\r\n"...)
+		} else {
+			buf = append(buf, "$-1\r\n"...)
+		}
+	case *myProto.Value_Integer:
+		buf = appendRespLine(buf, ':', strconv.FormatInt(k.Integer, 10))
+	case *myProto.Value_Double:
+		if resp == 3 {
+			buf = appendRespLine(buf, ',', formatDouble(k.Double))
+		} else {
+			buf = appendRespBulk(buf, []byte(formatDouble(k.Double)))
+		}
+	case *myProto.Value_Bulk:
+		buf = appendRespBulk(buf, k.Bulk)
+	case *myProto.Value_Status:
+		buf = appendRespLine(buf, '+', k.Status)
+	case *myProto.Value_Error:
+		buf = appendRespLine(buf, '-', k.Error)
+	case *myProto.Value_Map:
+		if resp == 3 {
+			buf = appendRespAggregate(buf, '%', len(k.Map.Entries))
+		} else {
+			buf = appendRespAggregate(buf, '*', 2*len(k.Map.Entries))
+		}
+		for _, e := range k.Map.Entries {
+			buf = appendRespValue(buf, e.Key, resp)
+			buf = appendRespValue(buf, e.Value, resp)
+		}
+	case *myProto.Value_Array:
+		buf = appendRespValues(buf, '*', k.Array.Values, resp)
+	case *myProto.Value_Set:
+		prefix := byte('*')
+		if resp == 3 {
+			prefix = '~'
+		}
+		buf = appendRespValues(buf, prefix, k.Set.Values, resp)
+	case *myProto.Value_Push:
+		prefix := byte('*')
+		if resp == 3 {
+			prefix = '>'
+		}
+		buf = appendRespValues(buf, prefix, k.Push.Values, resp)
+	}
+	return buf
+}
+
+func appendRespValues(buf []byte, prefix byte, values []*myProto.Value, resp int) []byte {
+	buf = appendRespAggregate(buf, prefix, len(values))
+	for _, v := range values {
+		buf = appendRespValue(buf, v, resp)
+	}
+	return buf
+}
@@ -0,0 +1,194 @@
+package godis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRespCommand(t *testing.T) {
+	tests := []struct {
+		in       string
+		args     []string
+		consumed int
+		done     bool
+	}{
+		{"*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", []string{"get", "key"}, 22, true},
+		{"*2\r\n$3\r\nget\r\n$3\r\nke", nil, 17, false},
+		{"*2\r\n$3\r\nget\r\n", nil, 13, false},
+		{"*2\r\n$3\r\nge", nil, 8, false},
+		{"*2\r", nil, 0, false},
+		{"*1\r\n$0\r\n\r\n", []string{""}, 10, true},
+		{"*2\r\n$3\r\nset\r\n$4\r\na\r\nb\r\n", []string{"set", "a\r\nb"}, 23, true},
+		{"*0\r\n", []string{}, 4, true},
+		{"ping\r\n", []string{"ping"}, 6, true},
+		{"set  key  value\n", []string{"set", "key", "value"}, 16, true},
+		{"ping", nil, 0, false},
+	}
+	for _, tt := range tests {
+		var p respParser
+		args, n, done, err := p.parse([]byte(tt.in), PROTO_MAX_ARGS_DEFAULT, PROTO_MAX_BULK_LEN_DEFAULT)
+		if err != nil {
+			t.Fatalf("parse(%q) returned an error: %v", tt.in, err)
+		}
+		if n != tt.consumed || done != tt.done || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("parse(%q) = %q, %d, %v; want %q, %d, %v", tt.in, args, n, done, tt.args, tt.consumed, tt.done)
+		}
+	}
+
+	for _, in := range []string{"*x\r\n", "*1\r\n+get\r\n", "*1\r\n$3\r\ngetxx", "*3\r\n", "*1\r\n$5\r\n"} {
+		var p respParser
+		if _, _, _, err := p.parse([]byte(in), 2, 4); err == nil {
+			t.Errorf("parse(%q) did not return a protocol error", in)
+		}
+	}
+}
+
+// TestParseRespCommandPieces feeds a request a byte at a time, the way a
+// client buffer keeps what wasn't consumed.
+func TestParseRespCommandPieces(t *testing.T) {
+	in := []byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\nping\r\n")
+	var p respParser
+	var buf []byte
+	var requests [][]string
+	for _, b := range in {
+		buf = append(buf, b)
+		args, n, done, err := p.parse(buf, PROTO_MAX_ARGS_DEFAULT, PROTO_MAX_BULK_LEN_DEFAULT)
+		if err != nil {
+			t.Fatalf("parse(%q) returned an error: %v", buf, err)
+		}
+		buf = buf[n:]
+		if done {
+			requests = append(requests, args)
+		}
+	}
+	if want := [][]string{{"set", "key", "value"}, {"ping"}}; !reflect.DeepEqual(requests, want) || len(buf) != 0 {
+		t.Fatalf("parsed %q leaving %q, want %q", requests, buf, want)
+	}
+
+	// the count announced doesn't size the allocation
+	p = respParser{}
+	if _, n, done, _ := p.parse([]byte("*1048576\r\n"), PROTO_MAX_ARGS_DEFAULT, PROTO_MAX_BULK_LEN_DEFAULT); n != 10 || done || cap(p.args) > RESP_MAX_ARGS_PREALLOC {
+		t.Fatalf("parse() of a huge count consumed %d, done %v, allocated %d arguments", n, done, cap(p.args))
+	}
+}
+
+func TestRespCommands(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestPort(t, server.resp_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	requests := "*1\r\n$4\r\nPING\r\n" +
+		"*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" +
+		"*2\r\n$3\r\nget\r\n$3\r\nkey\r\n" +
+		"*2\r\n$3\r\nget\r\n$7\r\nmissing\r\n" +
+		"*4\r\n$5\r\nrpush\r\n$4\r\nlist\r\n$1\r\na\r\n$1\r\nb\r\n" +
+		"lrange list 0 -1\r\n" +
+		"hget key field\r\n" +
+		"nosuchcommand\r\n"
+	want := "+PONG\r\n" +
+		"+OK\r\n" +
+		"$5\r\nvalue\r\n" +
+		"$-1\r\n" +
+		":2\r\n" +
+		"*2\r\n$1\r\na\r\n$1\r\nb\r\n" +
+		"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" +
+		"-ERR unknown command\r\n"
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Fatalf("Write() returned an error: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(bufio.NewReader(conn), got); err != nil {
+		t.Fatalf("ReadFull() returned an error: %v, got %q", err, got)
+	}
+	if string(got) != want {
+		t.Errorf("got replies %q, want %q", got, want)
+	}
+}
+
+// respRoundTrip sends one request and checks the exact reply.
+func respRoundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, request string, want string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Write() returned an error: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("%q: ReadFull() returned an error: %v, got %q", request, err, got)
+	}
+	if string(got) != want {
+		t.Errorf("%q: got reply %q, want %q", request, got, want)
+	}
+}
+
+// TestRespErrorLineNewlines sends an argument holding CRLF that the error
+// reply quotes, it must not split the error line in two replies.
+func TestRespErrorLineNewlines(t *testing.T) {
+	startTestServer(t, nil)
+	conn := dialTestPort(t, server.resp_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	respRoundTrip(t, conn, r, "*3\r\n$5\r\nHELLO\r\n$1\r\n2\r\n$12\r\nx\r\n+INJECTED\r\nPING\r\n",
+		"-ERR Syntax error in HELLO option 'x  +INJECTED'\r\n+PONG\r\n")
+}
+
+func TestResp3Hello(t *testing.T) {
+	startTestServer(t, func() { server.requirepass = "secret" })
+	conn := dialTestPort(t, server.resp_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	respRoundTrip(t, conn, r, "get key\r\n", "-NOAUTH Authentication required.\r\n")
+	respRoundTrip(t, conn, r, "hello 4\r\n", "-NOPROTO unsupported protocol version\r\n")
+	respRoundTrip(t, conn, r, "hello 3 auth default wrong\r\n", "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	conn.Write([]byte("hello 3 auth default secret setname app\r\n"))
+	var hello []string
+	for i := 0; i < 23; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString() returned an error: %v", err)
+		}
+		hello = append(hello, strings.TrimSuffix(line, "\r\n"))
+	}
+	if hello[0] != "%6" || hello[10] != "proto" || hello[11] != ":3" {
+		t.Fatalf("hello returned %q", hello)
+	}
+
+	respRoundTrip(t, conn, r, "hset h f v\r\n", ":1\r\n")
+	respRoundTrip(t, conn, r, "hgetall h\r\n", "%1\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	respRoundTrip(t, conn, r, "zadd z 1.5 m\r\n", ":1\r\n")
+	respRoundTrip(t, conn, r, "zscore z m\r\n", ",1.5\r\n")
+	respRoundTrip(t, conn, r, "zadd z 2 n\r\n", ":1\r\n")
+	respRoundTrip(t, conn, r, "zrange z 0 5 withscores\r\n", "*2\r\n*2\r\n$1\r\nm\r\n,1.5\r\n*2\r\n$1\r\nn\r\n,2\r\n")
+	respRoundTrip(t, conn, r, "sadd s m\r\n", ":1\r\n")
+	respRoundTrip(t, conn, r, "smembers s\r\n", "~1\r\n$1\r\nm\r\n")
+	respRoundTrip(t, conn, r, "get missing\r\n", "_\r\n")
+
+	// RESP3 connections may run commands while subscribed
+	respRoundTrip(t, conn, r, "subscribe news\r\n", ">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	respRoundTrip(t, conn, r, "publish news hi\r\n", ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n:1\r\n")
+}
+
+func TestResp2Subscribe(t *testing.T) {
+	startTestServer(t, nil)
+	sub := dialTestPort(t, server.resp_port)
+	sub.SetDeadline(time.Now().Add(5 * time.Second))
+	subr := bufio.NewReader(sub)
+	pub := dialTestPort(t, server.resp_port)
+	pub.SetDeadline(time.Now().Add(5 * time.Second))
+	pubr := bufio.NewReader(pub)
+
+	respRoundTrip(t, sub, subr, "subscribe a b\r\n",
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n")
+	respRoundTrip(t, sub, subr, "get a\r\n",
+		"-ERR Can't execute 'get': only SUBSCRIBE / UNSUBSCRIBE / PING are allowed in this context\r\n")
+	respRoundTrip(t, pub, pubr, "publish b hello\r\n", ":1\r\n")
+	respRoundTrip(t, sub, subr, "", "*3\r\n$7\r\nmessage\r\n$1\r\nb\r\n$5\r\nhello\r\n")
+	respRoundTrip(t, sub, subr, "unsubscribe a\r\n", "*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n")
+	respRoundTrip(t, pub, pubr, "publish a hello\r\n", ":0\r\n")
+}
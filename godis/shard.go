@@ -0,0 +1,235 @@
+package godis
+
+import (
+	myProto "godisdb/proto"
+	"hash/crc32"
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// A sharded server runs one event loop per shard, each in its own goroutine
+// with its own epoll instance and its own listening sockets bound with
+// SO_REUSEPORT, so the kernel spreads the connections between the shards.
+// The keyspace is partitioned by key hash: every shard owns the keys hashing
+// to it and only its loop ever touches them. A command whose keys belong to
+// another shard is forwarded to that shard's loop, which runs it on a
+// stand-in of the client and sends the replies back; a command whose keys
+// span several shards is rejected with a CROSSSLOT error. Clients, pub/sub
+// subscriptions, INFO and CLIENT LIST are local to the shard a connection
+// was accepted by.
+
+const SHARDS_MAX_NUM int = 64
+
+var str_err_crossslot string = "CROSSSLOT Keys in request don't hash to the same shard"
+
+type GodisShard struct {
+	id               int
+	loop             *AeEventLoop
+	db               map[int]*GodisDB
+	clients          map[int]*GodisClient
+	pubsub_channels  map[string]map[int]*GodisClient
+	clients_to_close []*GodisClient
+	ipfd             []int
+	resp_ipfd        []int
+	http_ipfd        []int
+	tls_ipfd         []int
+	shutting_down    bool // the shard runs no more requests of its clients
+}
+
+// createShard creates a shard with its keyspace, its event loop and its
+// listening sockets.
+func createShard(id int) *GodisShard {
+	s := &GodisShard{
+		id:               id,
+		db:               make(map[int]*GodisDB),
+		clients:          make(map[int]*GodisClient),
+		pubsub_channels:  make(map[string]map[int]*GodisClient),
+		clients_to_close: []*GodisClient{},
+	}
+	for i := 0; i < server.db_count; i++ {
+		s.db[i] = &GodisDB{
+			dict:    make(map[string]*GodisObj),
+			expires: make(map[string]int),
+		}
+	}
+
+	var err error
+	s.ipfd, err = listenToPort(server.port)
+	if err != nil {
+		panic(err)
+	}
+	//a zero port disables the RESP, HTTP or TLS listener
+	if server.resp_port != 0 {
+		s.resp_ipfd, err = listenToPort(server.resp_port)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if server.http_port != 0 {
+		s.http_ipfd, err = listenToPort(server.http_port)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if server.tls_port != 0 {
+		s.tls_ipfd, err = listenToPort(server.tls_port)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	s.loop, err = AeCreateEventLoopWithPoller(server.poller)
+	if err != nil && server.poller == AE_POLLER_EPOLL {
+		// epoll may be forbidden by a sandbox, poll(2) hardly ever is
+		log.Printf("Can't create an epoll instance, polling with poll instead: %v\n", err)
+		server.poller = AE_POLLER_POLL
+		s.loop, err = AeCreateEventLoopWithPoller(server.poller)
+	}
+	if err != nil {
+		panic(err)
+	}
+	for _, fd := range s.ipfd {
+		s.loop.AeCreateFileEvent(fd, AE_READABLE, handleClient, PROTO_PROTOBUF)
+	}
+	for _, fd := range s.resp_ipfd {
+		s.loop.AeCreateFileEvent(fd, AE_READABLE, handleClient, PROTO_RESP)
+	}
+	for _, fd := range s.http_ipfd {
+		s.loop.AeCreateFileEvent(fd, AE_READABLE, handleClient, PROTO_HTTP)
+	}
+	for _, fd := range s.tls_ipfd {
+		s.loop.AeCreateFileEvent(fd, AE_READABLE, handleTlsClient, nil)
+	}
+	s.loop.AeCreateTimeEvent(0, AE_NORMAL, findExpiredKey, nil)
+	s.loop.AeCreateTimeEvent(0, AE_NORMAL, serverCron, nil)
+	s.loop.AeAddBeforeSleepProc(beforeSleep)
+	return s
+}
+
+// shardOf returns the shard the event loop belongs to.
+func shardOf(loop *AeEventLoop) *GodisShard {
+	for _, s := range server.shards {
+		if s.loop == loop {
+			return s
+		}
+	}
+	return nil
+}
+
+// stopShards stops the event loop of every shard, it may be called from any
+// goroutine.
+func stopShards() {
+	for _, s := range server.shards {
+		s.loop.AePost(s.loop.AeStop)
+	}
+}
+
+// keyHashShard returns the shard owning key. When the key holds a non empty
+// hash tag between { and } only the tag is hashed, so that {user:1}:name and
+// {user:1}:age live on the same shard.
+func keyHashShard(key string) *GodisShard {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return server.shards[crc32.ChecksumIEEE([]byte(key))%uint32(len(server.shards))]
+}
+
+// getKeysShard returns the shard owning every key, nil when there is no key.
+// ok is false when the keys belong to several shards.
+func getKeysShard(keys []string) (shard *GodisShard, ok bool) {
+	for _, key := range keys {
+		s := keyHashShard(key)
+		if shard != nil && s != shard {
+			return nil, false
+		}
+		shard = s
+	}
+	return shard, true
+}
+
+// getBatchShard returns the shard owning every key of the batch, the way
+// getKeysShard does. Commands that can't run are ignored, they are replied
+// with their error by whichever shard runs the batch.
+func getBatchShard(batch *myProto.CmdBatch) (*GodisShard, bool) {
+	var keys []string
+	for _, cmd := range batch.Cmds {
+		command, ok := CommandTable[strings.ToLower(string(cmd.Command))]
+		if !ok || !arityOk(command, len(cmd.Args)) {
+			continue
+		}
+		keys = append(keys, getKeysFromCommand(command, bytesToStrings(cmd.Args))...)
+	}
+	return getKeysShard(keys)
+}
+
+// routeToShard forwards proc to the shard owning keys and returns true when
+// the keys aren't local, replying CROSSSLOT when they span several shards.
+func routeToShard(c *GodisClient, keys []string, proc func(fc *GodisClient)) bool {
+	if len(server.shards) == 1 {
+		return false
+	}
+	target, ok := getKeysShard(keys)
+	if !ok {
+		addReply(c, errorValue(str_err_crossslot))
+		return true
+	}
+	if target == nil || target == c.shard {
+		return false
+	}
+	forwardToShard(c, target, proc)
+	return true
+}
+
+// forwardToShard runs proc on the loop of the target shard with a stand-in
+// of the client, then queues the replies it collected to the client. The
+// client is blocked meanwhile: no more of its requests are processed, so
+// its replies stay in order.
+func forwardToShard(c *GodisClient, target *GodisShard, proc func(fc *GodisClient)) {
+	fc := createForwardedClient(c, target)
+	origin := c.shard
+	c.blocked = true
+	atomic.AddInt64(&server.stat_forwarded_commands, 1)
+	target.loop.AePost(func() {
+		proc(fc)
+		replies := fc.batch_replies
+		origin.loop.AePost(func() {
+			c.blocked = false
+			if origin.clients[c.fd] != c {
+				return
+			}
+			for _, v := range replies {
+				addReply(c, v)
+			}
+			processInputBuffer(c)
+		})
+	})
+}
+
+// createForwardedClient creates the stand-in a forwarded command runs on. It
+// carries what commands read from their client and collects the replies the
+// way a batch does, it has no connection.
+func createForwardedClient(c *GodisClient, target *GodisShard) *GodisClient {
+	return &GodisClient{
+		fd:               -1,
+		shard:            target,
+		proto:            c.proto,
+		resp:             c.resp,
+		authenticated:    c.authenticated,
+		db:               target.db[c.db_id],
+		db_id:            c.db_id,
+		name:             c.name,
+		arg_count:        c.arg_count,
+		command:          c.command,
+		args:             slices.Clone(c.args),
+		addr:             c.addr,
+		ctime:            c.ctime,
+		last_interaction: c.last_interaction,
+		batch_replies:    []*myProto.Value{},
+		proto_version:    c.proto_version,
+		frame_len:        -1,
+	}
+}
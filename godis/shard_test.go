@@ -0,0 +1,206 @@
+package godis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keysOnDifferentShards returns two keys owned by different shards.
+func keysOnDifferentShards() (string, string) {
+	for i := 1; ; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if keyHashShard(key) != keyHashShard("key:0") {
+			return "key:0", key
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	startTestServer(t, func() {
+		server.shards_num = 4
+		server.http_port = freePort(t)
+	})
+
+	// every connection pipelines commands on keys of every shard, the
+	// replies of the forwarded ones must come back in order
+	for i := 0; i < 8; i++ {
+		conn := dialTestServer(t)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		var buf []byte
+		for j := 0; j < 50; j++ {
+			key := fmt.Sprintf("key:%d:%d", i, j)
+			buf = appendCmd(buf, "set", key, key)
+			buf = appendCmd(buf, "get", key)
+		}
+		conn.Write(buf)
+		for j := 0; j < 50; j++ {
+			key := fmt.Sprintf("key:%d:%d", i, j)
+			if reply := readReply(t, r); reply.GetStatus() != "OK" {
+				t.Fatalf("set %s returned %v", key, reply)
+			}
+			if reply := readReply(t, r); string(reply.GetBulk()) != key {
+				t.Fatalf("get %s returned %v", key, reply)
+			}
+		}
+	}
+
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	k1, k2 := keysOnDifferentShards()
+	conn.Write(appendCmd(nil, "del", k1, k2))
+	if reply := readReply(t, r); reply.GetError() != str_err_crossslot {
+		t.Fatalf("del of keys on two shards returned %v", reply)
+	}
+	conn.Write(appendCmd(nil, "del", "{key:0:0}", "{key:0:0}:other", "key:0:0"))
+	if reply := readReply(t, r); reply.GetInteger() != 1 {
+		t.Fatalf("del of keys sharing a hash tag returned %v", reply)
+	}
+	conn.Write(appendBatch(nil, true, []string{"set", k1, "v"}, []string{"set", k2, "v"}))
+	if reply := readReply(t, r); reply.GetError() != str_err_crossslot {
+		t.Fatalf("a batch on two shards returned %v", reply)
+	}
+	conn.Write(appendBatch(nil, true, []string{"set", "{t}a", "1"}, []string{"get", "{t}a"}))
+	if reply := readReply(t, r).GetArray().GetValues(); len(reply) != 2 || string(reply[1].GetBulk()) != "1" {
+		t.Fatalf("a batch on one shard returned %v", reply)
+	}
+
+	// messages reach the subscribers of every shard
+	subscribers := make([]*bufio.Reader, 8)
+	for i := range subscribers {
+		sub := dialTestServer(t)
+		sub.SetDeadline(time.Now().Add(5 * time.Second))
+		subscribers[i] = bufio.NewReader(sub)
+		sub.Write(appendCmd(nil, "subscribe", "news"))
+		readReply(t, subscribers[i])
+	}
+	conn.Write(appendCmd(nil, "publish", "news", "hello"))
+	readReply(t, r)
+	for i, sr := range subscribers {
+		if msg := readReply(t, sr).GetPush().GetValues(); len(msg) != 3 || string(msg[2].GetBulk()) != "hello" {
+			t.Fatalf("subscriber %d got %v", i, msg)
+		}
+	}
+
+	// the keep-alive connection of the HTTP client is the 18th client
+	client := &http.Client{}
+	for _, key := range []string{k1, k2, "key:5:5"} {
+		status, result := httpDo(t, client, "GET", "/keys/"+key, "", "")
+		if key != "key:5:5" && status != http.StatusNotFound {
+			t.Fatalf("GET /keys/%s returned %d %v", key, status, result)
+		}
+		if key == "key:5:5" && result["result"] != key {
+			t.Fatalf("GET /keys/%s returned %d %v", key, status, result)
+		}
+	}
+
+	conn.Write(appendCmd(nil, "info"))
+	info := string(readReply(t, r).GetBulk())
+	for _, field := range []string{"shards:4\r\n", "connected_clients:18\r\n"} {
+		if !strings.Contains(info, field) {
+			t.Fatalf("INFO doesn't contain %q:\n%s", field, info)
+		}
+	}
+	if strings.Contains(info, "forwarded_commands:0\r\n") {
+		t.Fatalf("no command was forwarded:\n%s", info)
+	}
+}
+
+// TestShardsHttpPipelining pipelines keep-alive HTTP requests on keys of
+// different shards, the responses must come back in order.
+func TestShardsHttpPipelining(t *testing.T) {
+	startTestServer(t, func() {
+		server.shards_num = 2
+		server.http_port = freePort(t)
+	})
+	k1, k2 := keysOnDifferentShards()
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write(append(appendCmd(nil, "set", k1, "one"), appendCmd(nil, "set", k2, "two")...))
+	readReply(t, r)
+	readReply(t, r)
+
+	addr := net.JoinHostPort(server.bindaddr[0], strconv.Itoa(server.http_port))
+	for i := 0; i < 20; i++ {
+		hc := dialTestPort(t, server.http_port)
+		hc.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(hc, "GET /keys/%s HTTP/1.1\r\nHost: %s\r\n\r\nGET /keys/%s HTTP/1.1\r\nHost: %s\r\n\r\n", k1, addr, k2, addr)
+		hr := bufio.NewReader(hc)
+		for _, want := range []string{"one", "two"} {
+			resp, err := readHttpResponse(hr)
+			if err != nil {
+				t.Fatalf("connection %d: reading the response returned an error: %v", i, err)
+			}
+			if resp["result"] != want {
+				t.Fatalf("connection %d: got %v, want %s", i, resp, want)
+			}
+		}
+	}
+}
+
+func TestShardsHttpConnectionClose(t *testing.T) {
+	startTestServer(t, func() {
+		server.shards_num = 2
+		server.http_port = freePort(t)
+	})
+	k1, k2 := keysOnDifferentShards()
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write(append(appendCmd(nil, "set", k1, "one"), appendCmd(nil, "set", k2, "two")...))
+	readReply(t, r)
+	readReply(t, r)
+
+	// the connection is closed once the reply of the Connection: close
+	// request is sent, even when it comes from another shard
+	addr := net.JoinHostPort(server.bindaddr[0], strconv.Itoa(server.http_port))
+	for i := 0; i < 20; i++ {
+		hc := dialTestPort(t, server.http_port)
+		hc.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(hc, "GET /keys/%s HTTP/1.1\r\nHost: %s\r\n\r\nGET /keys/%s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", k1, addr, k2, addr)
+		hr := bufio.NewReader(hc)
+		for _, want := range []string{"one", "two"} {
+			resp, err := http.ReadResponse(hr, nil)
+			if err != nil {
+				t.Fatalf("connection %d: reading the response returned an error: %v", i, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			var result map[string]interface{}
+			json.Unmarshal(body, &result)
+			if result["result"] != want {
+				t.Fatalf("connection %d: got %s, want %s", i, body, want)
+			}
+			if resp.Close != (want == "two") {
+				t.Fatalf("connection %d: the response to %s has close %v", i, want, resp.Close)
+			}
+		}
+		if _, err := hr.ReadByte(); err != io.EOF {
+			t.Fatalf("connection %d: the connection wasn't closed after the reply, got %v", i, err)
+		}
+	}
+}
+
+func readHttpResponse(r *bufio.Reader) (map[string]interface{}, error) {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	err = json.Unmarshal(body, &result)
+	return result, err
+}
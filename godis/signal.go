@@ -0,0 +1,223 @@
+package godis
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Signals are received by a goroutine of the runtime and posted to the loop
+// of the first shard, so they are handled between events like everything
+// else. SIGTERM and SIGINT shut the server down gracefully: every shard
+// stops accepting connections and reading requests, writes the replies it
+// owes and stops its loop, freeing the clients still waiting once
+// shutdown-timeout passes. A second SIGTERM or SIGINT exits at once. SIGHUP
+// reloads the config file and reopens the log file, for log rotation.
+
+const SHUTDOWN_TIMEOUT_DEFAULT int = 10
+
+// initSignalHandlers starts routing SIGTERM, SIGINT and SIGHUP to the loop
+// of the first shard.
+func initSignalHandlers() {
+	ch := make(chan os.Signal, 8)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	server.signal_ch = ch
+	loop := server.shards[0].loop
+	go func() {
+		for sig := range ch {
+			loop.AePost(func() { handleSignal(sig.(syscall.Signal)) })
+		}
+	}()
+}
+
+// stopSignalHandlers gives the signals their default behavior back.
+func stopSignalHandlers() {
+	if server.signal_ch == nil {
+		return
+	}
+	signal.Stop(server.signal_ch)
+	close(server.signal_ch)
+	server.signal_ch = nil
+}
+
+func handleSignal(sig syscall.Signal) {
+	switch sig {
+	case syscall.SIGTERM, syscall.SIGINT:
+		if server.shutdown_asap {
+			log.Printf("Received %v during shutdown, exiting now.\n", sig)
+			os.Exit(1)
+		}
+		log.Printf("Received %v, scheduling shutdown...\n", sig)
+		prepareForShutdown()
+	case syscall.SIGHUP:
+		if server.shutdown_asap {
+			return
+		}
+		log.Printf("Received SIGHUP, reloading the config and reopening the log file.\n")
+		reloadServerConfig()
+		if err := openLogFile(); err != nil {
+			log.Printf("Can't reopen the log file %s: %v\n", server.logfile, err)
+		}
+	}
+}
+
+// shutdownState tracks the shutdown of a shard.
+type shutdownState struct {
+	deadline int
+	drained  bool // no client of the shard waits for a reply any more
+}
+
+// prepareForShutdown makes every shard stop serving new requests and stop
+// its loop once the replies of every shard are written. The keyspace lives
+// in memory only, there is nothing to persist.
+func prepareForShutdown() {
+	server.shutdown_asap = true
+	deadline := GetMsTime() + server.shutdown_timeout*1000
+	atomic.StoreInt64(&server.shards_draining, int64(len(server.shards)))
+	for _, s := range server.shards {
+		s.loop.AePost(func() {
+			s.shutting_down = true
+			closeShardListeningSockets(s)
+			for fd := range s.clients {
+				s.loop.AeDeleteFileEvent(fd, AE_READABLE, nil)
+			}
+			s.loop.AeCreateTimeEvent(0, AE_NORMAL, shutdownCron, &shutdownState{deadline: deadline})
+		})
+	}
+}
+
+// shutdownCron stops the loop of the shard and frees its clients once the
+// clients of every shard got their replies, or the shutdown deadline passes.
+// A drained shard keeps running the commands forwarded to it until then.
+func shutdownCron(loop *AeEventLoop, id int, extra interface{}) int {
+	s := shardOf(loop)
+	state := extra.(*shutdownState)
+	waiting := 0
+	for _, c := range s.clients {
+		if clientHasPendingReplies(c) || c.stream != nil || c.blocked {
+			waiting++
+		}
+	}
+	if waiting == 0 && !state.drained {
+		state.drained = true
+		atomic.AddInt64(&server.shards_draining, -1)
+	}
+	timedout := GetMsTime() >= state.deadline
+	if atomic.LoadInt64(&server.shards_draining) > 0 && !timedout {
+		return 10
+	}
+	if waiting > 0 {
+		log.Printf("Shard %d: %d clients still waiting for replies at the shutdown timeout.\n", s.id, waiting)
+	}
+	for _, c := range s.clients {
+		freeClient(c)
+	}
+	loop.AeDeleteTimeEvent(id)
+	loop.AeStop()
+	return 0
+}
+
+// openLogFile sends the log to the logfile, appending to it, or to stderr
+// when there is none. The file opened before is closed.
+func openLogFile() error {
+	var f *os.File
+	if server.logfile != "" {
+		var err error
+		f, err = os.OpenFile(server.logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	if server.log_file != nil {
+		server.log_file.Close()
+	}
+	server.log_file = f
+	return nil
+}
+
+// pauseShards parks the loops of all the shards but the first one until
+// resume is called, so that the loop of the first one can change what they
+// share.
+func pauseShards() (resume func()) {
+	var parked sync.WaitGroup
+	release := make(chan struct{})
+	for _, s := range server.shards[1:] {
+		parked.Add(1)
+		s.loop.AePost(func() {
+			parked.Done()
+			<-release
+		})
+	}
+	parked.Wait()
+	return func() { close(release) }
+}
+
+// reloadServerConfig reads the config file again and applies the settings
+// that can change while the server runs. A change of the others, such as
+// ports or the number of shards, is logged and ignored until a restart. A
+// file with errors is ignored as a whole.
+func reloadServerConfig() {
+	if server.configfile == "" {
+		log.Printf("The server was started without a config file, nothing to reload.\n")
+		return
+	}
+	resume := pauseShards()
+	defer resume()
+
+	live := server
+	fresh := newServerConfig()
+	if err := loadConfigFile(fresh, live.configfile); err != nil {
+		log.Printf("Can't reload the config, keeping the current one: %v\n", err)
+		return
+	}
+
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"bind", !slices.Equal(fresh.bindaddr, live.bindaddr)},
+		{"port", fresh.port != live.port},
+		{"resp-port", fresh.resp_port != live.resp_port},
+		{"http-port", fresh.http_port != live.http_port},
+		{"tls-port", fresh.tls_port != live.tls_port},
+		{"tls-cert-file", fresh.tls_cert_file != live.tls_cert_file},
+		{"tls-key-file", fresh.tls_key_file != live.tls_key_file},
+		{"tls-ca-cert-file", fresh.tls_ca_cert_file != live.tls_ca_cert_file},
+		{"tls-auth-clients", fresh.tls_auth_clients != live.tls_auth_clients},
+		{"unixsocket", fresh.unixsocket != live.unixsocket},
+		{"unixsocketperm", fresh.unixsocketperm != live.unixsocketperm},
+		{"shards", fresh.shards_num != live.shards_num},
+		{"io-threads", fresh.io_threads_num != live.configured_io_threads_num},
+		{"io-threads-do-reads", fresh.io_threads_do_reads != live.io_threads_do_reads},
+		{"poller", fresh.poller != live.configured_poller},
+	} {
+		if setting.changed {
+			log.Printf("Ignoring the new %s setting, it takes a restart.\n", setting.name)
+		}
+	}
+
+	live.requirepass = fresh.requirepass
+	if fresh.maxclients != live.maxclients {
+		// the open files limit may have to be raised, or maxclients lowered
+		live.maxclients = fresh.maxclients
+		adjustOpenFilesLimit()
+	}
+	live.maxidletime = fresh.maxidletime
+	live.tcpkeepalive = fresh.tcpkeepalive
+	live.compression_threshold = fresh.compression_threshold
+	live.reply_chunk_len = fresh.reply_chunk_len
+	live.client_max_querybuf_len = fresh.client_max_querybuf_len
+	live.proto_max_bulk_len = fresh.proto_max_bulk_len
+	live.proto_max_args = fresh.proto_max_args
+	live.client_obuf_limits = fresh.client_obuf_limits
+	live.shutdown_timeout = fresh.shutdown_timeout
+	live.logfile = fresh.logfile
+	log.Printf("Reloaded the config from %s.\n", live.configfile)
+}
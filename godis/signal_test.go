@@ -0,0 +1,208 @@
+package godis
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// startSignalTestServer runs a test server handling the signals sent to the
+// test process.
+func startSignalTestServer(t *testing.T, config func()) {
+	// cleanups run last to first, the loops are stopped by then
+	t.Cleanup(stopSignalHandlers)
+	startTestServer(t, config)
+	initSignalHandlers()
+}
+
+func TestSignalShutdown(t *testing.T) {
+	startSignalTestServer(t, func() {
+		server.shards_num = 2
+	})
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	big := strings.Repeat("x", 4*1024*1024)
+	buf := appendCmd(nil, "set", "big", big)
+	for i := 0; i < 4; i++ {
+		buf = appendCmd(buf, "get", "big")
+	}
+	conn.Write(buf)
+	time.Sleep(100 * time.Millisecond)
+
+	unix.Kill(os.Getpid(), unix.SIGTERM)
+	addr := net.JoinHostPort(server.bindaddr[0], strconv.Itoa(server.port))
+	for i := 0; ; i++ {
+		other, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		other.Close()
+		if i == 100 {
+			t.Fatal("the server still accepts connections after SIGTERM")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the replies owed are written before the connection is closed
+	r := bufio.NewReader(conn)
+	if reply := readReply(t, r); reply.GetStatus() != "OK" {
+		t.Fatalf("set returned %v", reply)
+	}
+	for i := 0; i < 4; i++ {
+		if reply := readReply(t, r); string(reply.GetBulk()) != big {
+			t.Fatalf("get %d did not return the whole value", i)
+		}
+	}
+	expectClosed(t, r)
+}
+
+func TestSignalReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "godis.conf")
+	logfile := filepath.Join(dir, "godis.log")
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		if server.log_file != nil {
+			server.log_file.Close()
+		}
+	})
+	startSignalTestServer(t, func() {
+		server.configfile = path
+		server.shards_num = 2
+		server.io_threads_num = 4
+	})
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	os.WriteFile(path, []byte("requirepass secret\nlogfile "+logfile+"\nshards 4\n"), 0600)
+	unix.Kill(os.Getpid(), unix.SIGHUP)
+	for i := 0; ; i++ {
+		conn.Write(appendCmd(nil, "ping"))
+		if strings.HasPrefix(readReply(t, r).GetError(), "NOAUTH") {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the new requirepass wasn't applied after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a file with errors leaves the config as it is
+	os.WriteFile(path, []byte("requirepass other\nmaxclients 0\n"), 0600)
+	unix.Kill(os.Getpid(), unix.SIGHUP)
+	for i := 0; ; i++ {
+		contents, _ := os.ReadFile(logfile)
+		if strings.Contains(string(contents), "keeping the current one") {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("the log file doesn't mention the rejected config:\n%s", contents)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Write(appendCmd(nil, "auth", "secret"))
+	if reply := readReply(t, r); reply.GetStatus() != "OK" {
+		t.Fatalf("auth returned %v", reply)
+	}
+
+	// io-threads is lowered to 1 with several shards, the setting didn't
+	// change though; maxclients can't grow past the open files limit
+	os.WriteFile(path, []byte("requirepass secret\nlogfile "+logfile+"\nshards 2\nio-threads 4\nmaxclients 100000000\n"), 0600)
+	unix.Kill(os.Getpid(), unix.SIGHUP)
+	for i := 0; ; i++ {
+		contents, _ := os.ReadFile(logfile)
+		if strings.Contains(string(contents), "Reloaded the config") {
+			if strings.Contains(string(contents), "new io-threads") || strings.Contains(string(contents), "new poller") {
+				t.Fatalf("the log warns about settings that didn't change:\n%s", contents)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("the log file doesn't mention the reload:\n%s", contents)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Write(appendCmd(nil, "info", "clients"))
+	info := string(readReply(t, r).GetBulk())
+	var limit unix.Rlimit
+	unix.Getrlimit(unix.RLIMIT_NOFILE, &limit)
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, "maxclients:"); ok {
+			if maxclients, _ := strconv.Atoi(value); uint64(maxclients+MIN_RESERVED_FDS*2) > limit.Cur {
+				t.Fatalf("maxclients is %d with an open files limit of %d", maxclients, limit.Cur)
+			}
+		}
+	}
+}
+
+func TestSignalShutdownForwardedReply(t *testing.T) {
+	startSignalTestServer(t, func() {
+		server.shards_num = 2
+	})
+	onShard := func(s *GodisShard, proc func()) {
+		done := make(chan struct{})
+		s.loop.AePost(func() {
+			proc()
+			close(done)
+		})
+		<-done
+	}
+	// a connection served by the first shard, which handles the signals
+	var conn net.Conn
+	for i := 0; conn == nil; i++ {
+		c := dialTestServer(t)
+		time.Sleep(10 * time.Millisecond)
+		onShard(server.shards[0], func() {
+			for _, client := range server.shards[0].clients {
+				if client.addr == c.LocalAddr().String() {
+					conn = c
+				}
+			}
+		})
+		if i == 100 {
+			t.Fatal("no connection was accepted by the first shard")
+		}
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var remote, local string
+	for i := 0; remote == "" || local == ""; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if keyHashShard(key) == server.shards[1] {
+			remote = key
+		} else {
+			local = key
+		}
+	}
+
+	// the command waits on the second shard while the shutdown starts
+	release := make(chan struct{})
+	server.shards[1].loop.AePost(func() { <-release })
+	conn.Write(appendCmd(appendCmd(nil, "get", remote), "set", local, "v"))
+	time.Sleep(50 * time.Millisecond)
+	unix.Kill(os.Getpid(), unix.SIGTERM)
+	for shutting := false; !shutting; {
+		time.Sleep(10 * time.Millisecond)
+		onShard(server.shards[0], func() { shutting = server.shards[0].shutting_down })
+	}
+	close(release)
+
+	// the forwarded reply is written, the command after it doesn't run
+	r := bufio.NewReader(conn)
+	if reply := readReply(t, r); reply.GetNull() == nil {
+		t.Fatalf("get returned %v", reply)
+	}
+	expectClosed(t, r)
+	if _, ok := server.shards[0].db[0].dict[local]; ok {
+		t.Fatal("the command pipelined after the forwarded one ran during the shutdown")
+	}
+}
@@ -0,0 +1,223 @@
+package godis
+
+import (
+	myProto "godisdb/proto"
+	"iter"
+	"maps"
+	"sync/atomic"
+)
+
+// Large LRANGE, HGETALL and SMEMBERS replies are streamed: the command only
+// sets up a cursor over the object and the elements are serialized a chunk
+// at a time, each chunk once the previous one has been written to the
+// socket. Neither the whole result nor the whole serialized reply is held in
+// memory, and a huge reply doesn't keep the loop from serving other clients
+// between its chunks. RESP clients get the usual aggregate, written in
+// pieces; protobuf clients get a reply per chunk flagged with more and put
+// the value back together with MergeReplyChunk.
+//
+// The client reads nothing else until the stream ends, so its replies stay
+// in order, and an object being streamed is copied by the next command that
+// changes it, so the reply sees the value the command found.
+
+const REPLY_CHUNK_LEN_DEFAULT int = 1024
+
+// replyStream is the cursor of a streamed reply.
+type replyStream struct {
+	obj   *GodisObj
+	kind  ReplyType // RE_LIST, RE_HASH or RE_SET
+	total int       // elements of the reply, field-value pairs for a hash
+	sent  int
+	next  func(n int) []string // the next n elements, flattened pairs for a hash
+	stop  func()               // releases the cursor
+}
+
+func listStream(obj *GodisObj, start int, stop int) *replyStream {
+	node := obj.val.(*GodisList).listGetIndex(int64(start))
+	return &replyStream{
+		obj:   obj,
+		kind:  RE_LIST,
+		total: stop - start + 1,
+		next: func(n int) []string {
+			elems := make([]string, 0, n)
+			for ; n > 0 && node != nil; n-- {
+				elems = append(elems, node.val.val.(string))
+				node = node.next
+			}
+			return elems
+		},
+		stop: func() {},
+	}
+}
+
+func hashStream(obj *GodisObj) *replyStream {
+	hash := obj.val.(GodisHash)
+	next, stop := iter.Pull2(maps.All(hash))
+	return &replyStream{
+		obj:   obj,
+		kind:  RE_HASH,
+		total: len(hash),
+		next: func(n int) []string {
+			elems := make([]string, 0, 2*n)
+			for ; n > 0; n-- {
+				field, value, ok := next()
+				if !ok {
+					break
+				}
+				elems = append(elems, field, value.val.(string))
+			}
+			return elems
+		},
+		stop: stop,
+	}
+}
+
+func setStream(obj *GodisObj) *replyStream {
+	set := obj.val.(GodisSet)
+	next, stop := iter.Pull(maps.Keys(set))
+	return &replyStream{
+		obj:   obj,
+		kind:  RE_SET,
+		total: len(set),
+		next: func(n int) []string {
+			elems := make([]string, 0, n)
+			for ; n > 0; n-- {
+				member, ok := next()
+				if !ok {
+					break
+				}
+				elems = append(elems, member)
+			}
+			return elems
+		},
+		stop: stop,
+	}
+}
+
+// clientCanStream reports whether replies can be streamed to the client.
+// Replies collected by a batch or a forwarded command, replies serialized by
+// the IO threads and HTTP replies are built whole, and so are the replies of
+// protobuf clients that can't put chunks back together.
+func clientCanStream(c *GodisClient) bool {
+	if server.reply_chunk_len == 0 || c.batch_replies != nil || clientUsesThreadedWrites(c) {
+		return false
+	}
+	return c.proto == PROTO_RESP || (c.proto == PROTO_PROTOBUF && c.proto_version >= 3)
+}
+
+// addReplyStream replies with the elements of the stream, streamed when they
+// don't fit in one chunk.
+func addReplyStream(c *GodisClient, st *replyStream) {
+	if c.close_asap {
+		st.stop()
+		return
+	}
+	if st.total <= server.reply_chunk_len || !clientCanStream(c) {
+		genReply(c, st.kind, nil, 0, st.next(st.total))
+		st.stop()
+		return
+	}
+	atomic.AddInt64(&server.stat_streamed_replies, 1)
+	st.obj.streams++
+	c.stream = st
+	c.blocked = true
+	streamNextChunk(c)
+}
+
+// streamNextChunk serializes the next chunk of the streamed reply into the
+// output buffer and ends the stream after the last one.
+func streamNextChunk(c *GodisClient) {
+	st := c.stream
+	n := min(server.reply_chunk_len, st.total-st.sent)
+	elems := st.next(n)
+	first := st.sent == 0
+	st.sent += n
+	more := st.sent < st.total
+
+	prepareClientToWrite(c)
+	if c.proto == PROTO_RESP {
+		if first {
+			c.buf = appendRespStreamHeader(c.buf, st, c.resp)
+		}
+		for _, elem := range elems {
+			c.buf = appendRespBulk(c.buf, []byte(elem))
+		}
+	} else {
+		var v *myProto.Value
+		switch st.kind {
+		case RE_HASH:
+			v = mapValue(bulkValues(elems)...)
+		case RE_SET:
+			v = setValue(bulkValues(elems)...)
+		default:
+			v = arrayValue(bulkValues(elems)...)
+		}
+		buf, err := appendProtobufReply(c.buf, c, &myProto.Reply{Value: v, More: more})
+		if err == nil {
+			c.buf = buf
+		}
+	}
+	if !more {
+		freeReplyStream(c)
+	}
+	closeClientOnOutputBufferLimitReached(c)
+}
+
+// appendRespStreamHeader serializes the header of the aggregate a streamed
+// reply is sent as.
+func appendRespStreamHeader(buf []byte, st *replyStream, resp int) []byte {
+	switch {
+	case st.kind == RE_HASH && resp == 3:
+		return appendRespAggregate(buf, '%', st.total)
+	case st.kind == RE_HASH:
+		return appendRespAggregate(buf, '*', 2*st.total)
+	case st.kind == RE_SET && resp == 3:
+		return appendRespAggregate(buf, '~', st.total)
+	}
+	return appendRespAggregate(buf, '*', st.total)
+}
+
+// freeReplyStream ends the streamed reply of the client, the messages
+// published to it meanwhile are queued after the reply.
+func freeReplyStream(c *GodisClient) {
+	st := c.stream
+	if st == nil {
+		return
+	}
+	st.stop()
+	st.obj.streams--
+	c.stream = nil
+	c.blocked = false
+	deferred := c.deferred_replies
+	c.deferred_replies = nil
+	for _, v := range deferred {
+		addReply(c, v)
+	}
+}
+
+// unshareObject gives key a copy of its object when a reply is streaming the
+// object or an atomic batch may restore it, so that neither sees the changes
+// a command is about to make.
+func unshareObject(db *GodisDB, key string) {
+	if obj, ok := db.dict[key]; ok && (obj.streams > 0 || obj.snapshots > 0) {
+		db.dict[key] = dupObject(obj)
+	}
+}
+
+// MergeReplyChunk appends the elements of a chunk flagged with more, or of
+// the last chunk, to the value the previous chunks were merged into. v is
+// nil for the first chunk.
+func MergeReplyChunk(v *myProto.Value, chunk *myProto.Value) *myProto.Value {
+	if v == nil {
+		return chunk
+	}
+	switch k := v.GetKind().(type) {
+	case *myProto.Value_Array:
+		k.Array.Values = append(k.Array.Values, chunk.GetArray().GetValues()...)
+	case *myProto.Value_Set:
+		k.Set.Values = append(k.Set.Values, chunk.GetSet().GetValues()...)
+	case *myProto.Value_Map:
+		k.Map.Entries = append(k.Map.Entries, chunk.GetMap().GetEntries()...)
+	}
+	return v
+}
@@ -0,0 +1,123 @@
+package godis
+
+import (
+	"bufio"
+	"fmt"
+	myProto "godisdb/proto"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+func TestStreamedReplies(t *testing.T) {
+	startTestServer(t, func() {
+		server.reply_chunk_len = 100
+	})
+	conn := dialTestServer(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	elems := make([]string, 1000)
+	var buf []byte
+	for i := range elems {
+		elems[i] = fmt.Sprintf("e%d", i)
+		buf = appendCmd(buf, "hset", "h", elems[i], elems[i])
+		buf = appendCmd(buf, "sadd", "s", elems[i])
+	}
+	buf = appendCmd(buf, "rpush", append([]string{"l"}, elems...)...)
+	conn.Write(buf)
+	for range elems {
+		readReply(t, r)
+		readReply(t, r)
+	}
+	readReply(t, r)
+
+	// the list comes in chunks, followed by the reply of the next command
+	conn.Write(append(appendCmd(nil, "lrange", "l", "0", "-1"), appendCmd(nil, "ping")...))
+	chunks := 0
+	var list []string
+	for {
+		var reply myProto.Reply
+		if err := (protodelim.UnmarshalOptions{MaxSize: -1}).UnmarshalFrom(r, &reply); err != nil {
+			t.Fatalf("UnmarshalFrom() returned an error: %v", err)
+		}
+		chunks++
+		for _, v := range reply.Value.GetArray().GetValues() {
+			list = append(list, string(v.GetBulk()))
+		}
+		if !reply.More {
+			break
+		}
+	}
+	if chunks != 10 || strings.Join(list, ",") != strings.Join(elems, ",") {
+		t.Fatalf("lrange returned %d elements in %d chunks", len(list), chunks)
+	}
+	if reply := readReply(t, r); reply.GetStatus() != "PONG" {
+		t.Fatalf("ping after lrange returned %v", reply)
+	}
+
+	conn.Write(appendCmd(nil, "hgetall", "h"))
+	if entries := readReply(t, r).GetMap().GetEntries(); len(entries) != 1000 {
+		t.Fatalf("hgetall returned %d entries", len(entries))
+	}
+	conn.Write(appendCmd(nil, "smembers", "s"))
+	if members := readReply(t, r).GetSet().GetValues(); len(members) != 1000 {
+		t.Fatalf("smembers returned %d members", len(members))
+	}
+
+	// RESP gets a single aggregate
+	resp := dialTestPort(t, server.resp_port)
+	resp.SetDeadline(time.Now().Add(5 * time.Second))
+	var want strings.Builder
+	fmt.Fprintf(&want, "*%d\r\n", len(elems))
+	for _, e := range elems {
+		fmt.Fprintf(&want, "$%d\r\n%s\r\n", len(e), e)
+	}
+	want.WriteString("+PONG\r\n")
+	respRoundTrip(t, resp, bufio.NewReader(resp), "LRANGE l 0 -1\r\nPING\r\n", want.String())
+
+	conn.Write(appendCmd(nil, "info", "stats"))
+	if info := string(readReply(t, r).GetBulk()); !strings.Contains(info, "streamed_replies:4\r\n") {
+		t.Fatalf("INFO stats doesn't count 4 streamed replies:\n%s", info)
+	}
+}
+
+// TestStreamedReplySnapshot changes a list while a reply streams it to a
+// client that doesn't read, the reply must hold the list as it was.
+func TestStreamedReplySnapshot(t *testing.T) {
+	startTestServer(t, func() {
+		server.reply_chunk_len = 10
+	})
+	value := strings.Repeat("v", 1024)
+	reader := dialTestServer(t)
+	reader.SetDeadline(time.Now().Add(10 * time.Second))
+	writer := dialTestServer(t)
+	writer.SetDeadline(time.Now().Add(10 * time.Second))
+	wr := bufio.NewReader(writer)
+
+	args := []string{"l"}
+	for i := 0; i < 8192; i++ {
+		args = append(args, value)
+	}
+	writer.Write(appendCmd(nil, "rpush", args...))
+	readReply(t, wr)
+
+	// 8MB don't fit in the socket buffers, the stream stays open
+	reader.Write(appendCmd(nil, "lrange", "l", "0", "-1"))
+	time.Sleep(100 * time.Millisecond)
+	writer.Write(appendCmd(nil, "lset", "l", "0", "changed"))
+	writer.Write(appendCmd(nil, "rpop", "l"))
+	writer.Write(appendCmd(nil, "lrange", "l", "0", "0"))
+	readReply(t, wr)
+	readReply(t, wr)
+	if reply := readReply(t, wr).GetArray().GetValues(); len(reply) != 1 || string(reply[0].GetBulk()) != "changed" {
+		t.Fatalf("lrange after lset returned %v", reply)
+	}
+
+	list := readReply(t, bufio.NewReader(reader)).GetArray().GetValues()
+	if len(list) != 8192 || string(list[0].GetBulk()) != value {
+		t.Fatalf("the streamed lrange returned %d elements, the first one %.10q", len(list), list[0].GetBulk())
+	}
+}
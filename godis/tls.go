@@ -0,0 +1,258 @@
+package godis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"iter"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type TlsAuthClients int
+
+const (
+	TLS_CLIENT_AUTH_NO       TlsAuthClients = 0
+	TLS_CLIENT_AUTH_YES      TlsAuthClients = 1
+	TLS_CLIENT_AUTH_OPTIONAL TlsAuthClients = 2
+)
+
+type tlsWouldBlock struct{}
+
+func (tlsWouldBlock) Error() string   { return "tls: operation would block" }
+func (tlsWouldBlock) Timeout() bool   { return true }
+func (tlsWouldBlock) Temporary() bool { return true }
+
+// errWouldBlock is returned by tlsTransport when no ciphertext is buffered.
+// It is a temporary net.Error so crypto/tls keeps the connection usable and
+// retries the read once the event loop has buffered more data.
+var errWouldBlock net.Error = tlsWouldBlock{}
+
+// tlsTransport is the net.Conn under a tls.Conn. It never touches the socket:
+// the event loop feeds it the ciphertext read from the fd in readClient and
+// writes out what it collected in replyToClient.
+type tlsTransport struct {
+	fd  int
+	in  []byte // ciphertext read from the socket and not consumed yet
+	out []byte // ciphertext produced by crypto/tls and not sent yet
+
+	// yield suspends the handshake coroutine until more ciphertext arrives,
+	// it is nil once the handshake is over.
+	yield func(struct{}) bool
+}
+
+func (t *tlsTransport) Read(p []byte) (int, error) {
+	for len(t.in) == 0 {
+		if t.yield == nil {
+			return 0, errWouldBlock
+		}
+		if !t.yield(struct{}{}) {
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(p, t.in)
+	t.in = t.in[n:]
+	return n, nil
+}
+
+func (t *tlsTransport) Write(p []byte) (int, error) {
+	t.out = append(t.out, p...)
+	return len(p), nil
+}
+
+func (t *tlsTransport) Close() error                     { return nil }
+func (t *tlsTransport) SetDeadline(time.Time) error      { return nil }
+func (t *tlsTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *tlsTransport) SetWriteDeadline(time.Time) error { return nil }
+
+func (t *tlsTransport) LocalAddr() net.Addr {
+	sa, _ := unix.Getsockname(t.fd)
+	return sockaddrToAddr(sa)
+}
+
+func (t *tlsTransport) RemoteAddr() net.Addr {
+	sa, _ := unix.Getpeername(t.fd)
+	return sockaddrToAddr(sa)
+}
+
+// GodisTlsConn is the TLS state of a client accepted on the tls port.
+type GodisTlsConn struct {
+	transport *tlsTransport
+	conn      *tls.Conn
+	// the handshake runs as a coroutine resumed from the event loop
+	// callbacks only, it never runs concurrently with the loop
+	handshake     func() (struct{}, bool)
+	stopHandshake func()
+	handshakeErr  error
+}
+
+func createTlsConn(fd int) *GodisTlsConn {
+	t := &GodisTlsConn{
+		transport: &tlsTransport{fd: fd},
+	}
+	t.conn = tls.Server(t.transport, server.tls_config)
+	t.handshake, t.stopHandshake = iter.Pull(func(yield func(struct{}) bool) {
+		t.transport.yield = yield
+		t.handshakeErr = t.conn.Handshake()
+		t.transport.yield = nil
+	})
+	return t
+}
+
+func (t *GodisTlsConn) handshaking() bool {
+	return t.handshake != nil
+}
+
+// continueHandshake runs the handshake until it needs more input or ends.
+func (t *GodisTlsConn) continueHandshake() error {
+	if _, more := t.handshake(); more {
+		return nil
+	}
+	t.handshake = nil
+	t.stopHandshake = nil
+	return t.handshakeErr
+}
+
+func (t *GodisTlsConn) close() {
+	if t.stopHandshake != nil {
+		t.stopHandshake()
+	}
+}
+
+// flush writes the pending ciphertext, returns true when nothing is left.
+func (t *GodisTlsConn) flush() (bool, error) {
+	for len(t.transport.out) > 0 {
+		n, err := unix.Write(t.transport.fd, t.transport.out)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		t.transport.out = t.transport.out[n:]
+	}
+	t.transport.out = nil
+	return true, nil
+}
+
+// readTlsClient reads ciphertext from the socket, advances the handshake and
+// appends the decrypted data to the query buffer.
+func readTlsClient(c *GodisClient) {
+	t := c.tls
+	buf := make([]byte, IOBUF_LEN)
+	n, err := unix.Read(c.fd, buf)
+	if err == unix.EAGAIN {
+		return
+	}
+	if err != nil {
+		log.Printf("readClient read error: %v\n", err)
+		freeClient(c)
+		return
+	}
+	if n == 0 {
+		freeClient(c)
+		return
+	}
+	c.last_interaction = GetMsTime()
+	t.transport.in = append(t.transport.in, buf[:n]...)
+
+	if t.handshaking() {
+		err = t.continueHandshake()
+		if err != nil {
+			log.Printf("Error accepting a client connection: %v\n", err)
+			t.flush()
+			freeClient(c)
+			return
+		}
+	}
+	if !t.handshaking() {
+		for {
+			n, err = t.conn.Read(buf)
+			c.query_buf = append(c.query_buf, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		if err != errWouldBlock {
+			if err != io.EOF {
+				log.Printf("readClient tls error: %v\n", err)
+			}
+			t.flush()
+			freeClient(c)
+			return
+		}
+		if len(c.query_buf) > server.client_max_querybuf_len {
+			freeClientOnReadError(c, errQueryBufferLimit)
+			return
+		}
+	}
+	// the handshake or a post handshake message may have produced output
+	if len(t.transport.out) > 0 {
+		c.shard.loop.AeCreateFileEvent(c.fd, AE_WRITABLE, replyToClient, nil)
+	}
+	processInputBuffer(c)
+}
+
+// writeTlsClient encrypts the output buffer and sends as much ciphertext as
+// the socket accepts, returns true when everything has been sent.
+func writeTlsClient(c *GodisClient) (bool, error) {
+	t := c.tls
+	if !t.handshaking() && c.sentlen < len(c.buf) {
+		t.conn.Write(c.buf[c.sentlen:])
+		resetOutputBuffer(c)
+	}
+	pending := len(t.transport.out)
+	done, err := t.flush()
+	// a client slowly reading a big reply isn't idle
+	if len(t.transport.out) < pending {
+		c.last_interaction = GetMsTime()
+	}
+	return done, err
+}
+
+// tlsConfigure builds the server side TLS configuration from the tls-*
+// settings.
+func tlsConfigure() (*tls.Config, error) {
+	if server.tls_cert_file == "" || server.tls_key_file == "" {
+		return nil, fmt.Errorf("tls-cert-file and tls-key-file are required with tls-port")
+	}
+	cert, err := tls.LoadX509KeyPair(server.tls_cert_file, server.tls_key_file)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if server.tls_ca_cert_file != "" {
+		pem, err := os.ReadFile(server.tls_ca_cert_file)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", server.tls_ca_cert_file)
+		}
+		config.ClientCAs = pool
+	}
+	switch server.tls_auth_clients {
+	case TLS_CLIENT_AUTH_YES:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case TLS_CLIENT_AUTH_OPTIONAL:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		config.ClientAuth = tls.NoClientCert
+	}
+	if config.ClientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, fmt.Errorf("tls-ca-cert-file is required to verify client certificates")
+	}
+	return config, nil
+}
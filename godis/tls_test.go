@@ -0,0 +1,136 @@
+package godis
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// genTestCert writes a certificate and its key to dir, the certificate is
+// self-signed when parent is nil.
+func genTestCert(t *testing.T, dir string, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() returned an error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() returned an error: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+func TestTlsConnection(t *testing.T) {
+	dir := t.TempDir()
+	ca := genTestCert(t, dir, "ca", nil)
+	serverCert := genTestCert(t, dir, "server", ca)
+	clientCert := genTestCert(t, dir, "client", ca)
+	startTestServer(t, func() {
+		server.tls_port = freePort(t)
+		server.tls_cert_file = serverCert.certFile
+		server.tls_key_file = serverCert.keyFile
+		server.tls_ca_cert_file = ca.certFile
+		server.tls_auth_clients = TLS_CLIENT_AUTH_YES
+	})
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(server.tls_port))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	pair, err := tls.LoadX509KeyPair(clientCert.certFile, clientCert.keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() returned an error: %v", err)
+	}
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{pair},
+			MaxVersion:   version,
+		})
+		if err != nil {
+			t.Fatalf("tls.Dial() returned an error: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+
+		big := strings.Repeat("v", 100*1024)
+		buf := appendCmd(nil, "set", "big", big)
+		buf = appendCmd(buf, "get", "big")
+		buf = appendCmd(buf, "ping")
+		conn.Write(buf)
+		if reply := readReply(t, r); reply.GetStatus() != "OK" {
+			t.Errorf("set returned %v", reply)
+		}
+		if reply := readReply(t, r); string(reply.GetBulk()) != big {
+			t.Error("get did not return the whole value")
+		}
+		if reply := readReply(t, r); reply.GetStatus() != "PONG" {
+			t.Errorf("ping returned %v", reply)
+		}
+	}
+
+	// a client without a certificate is turned away
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(appendCmd(nil, "ping"))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Error("a client without a certificate was served")
+		}
+	}
+
+	// plaintext clients are served next to TLS ones
+	plain := dialTestServer(t)
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	plain.Write(appendCmd(nil, "ping"))
+	if reply := readReply(t, bufio.NewReader(plain)); reply.GetStatus() != "PONG" {
+		t.Errorf("plaintext ping returned %v", reply)
+	}
+}
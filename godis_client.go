@@ -1,27 +1,50 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
 	"godisdb/godis"
 	myProto "godisdb/proto"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/chzyer/readline"
+	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/proto"
 )
 
+// compression is the codec the server acked, commands are only compressed
+// once it did.
+var compression string
+
 func main() {
+	useTls := flag.Bool("tls", false, "connect to the tls port")
+	cacert := flag.String("cacert", "", "CA certificate used to verify the server")
+	cert := flag.String("cert", "", "client certificate")
+	key := flag.String("key", "", "client private key")
+	flag.Parse()
+
 	// connect to godisdb
-	path := os.Args[1]
-	conn, err := net.Dial("tcp", path)
+	path := flag.Arg(0)
+	var conn net.Conn
+	var err error
+	if *useTls {
+		conn, err = dialTls(path, *cacert, *cert, *key)
+	} else {
+		conn, err = net.Dial("tcp", path)
+	}
 
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
 	defer conn.Close()
+	reader := bufio.NewReader(conn)
 
 	// readline
 	fmt.Println("godis-client")
@@ -52,117 +75,302 @@ func main() {
 			break
 		}
 
-		err = sendCommand(line, conn)
+		sent, err := sendCommand(line, conn)
 		if err != nil {
 			break
 		}
-		recvReply(conn)
+		// nothing to wait for when the line didn't make a command
+		if !sent {
+			continue
+		}
+		recvReply(reader)
+		// a subscribed connection only receives pushed messages from now on
+		if fields := strings.Fields(line); len(fields) > 0 && strings.ToLower(fields[0]) == "subscribe" {
+			for recvReply(reader) == nil {
+			}
+		}
 	}
 
 }
 
-func sendCommand(command string, conn net.Conn) error {
-
-	slice := strings.Fields(command)
-	if len(slice) == 0 {
-		fmt.Println(">")
-	} else if len(slice) == 1 {
-		var cmd = &myProto.Cmd{
-			Command: slice[0],
-		}
-		data, _ := proto.Marshal(cmd)
-
-		_, err := conn.Write(data)
+func dialTls(path string, cacert string, cert string, key string) (net.Conn, error) {
+	config := &tls.Config{}
+	if cacert != "" {
+		pem, err := os.ReadFile(cacert)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return err
+			return nil, err
 		}
-	} else {
-		var cmd = &myProto.Cmd{
-			Command: slice[0],
-			Args:    slice[1:],
-		}
-		data, _ := proto.Marshal(cmd)
-		_, err := conn.Write(data)
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(pem)
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return err
+			return nil, err
 		}
+		config.Certificates = []tls.Certificate{pair}
 	}
-	return nil
+	return tls.Dial("tcp", path, config)
 }
 
-func recvReply(conn net.Conn) {
-	var buf [1024]byte
-	n, err := conn.Read(buf[:])
+// sendCommand sends the command typed on a line and reports whether it was
+// sent, a line that can't be parsed is reported and skipped.
+func sendCommand(command string, conn net.Conn) (bool, error) {
+
+	slice, err := splitArgs(command)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		return
+		return false, nil
 	}
-	var reply myProto.Reply
-	err = proto.Unmarshal(buf[:n], &reply)
+	if len(slice) == 0 {
+		fmt.Println(">")
+		return false, nil
+	}
+	var cmd = &myProto.Cmd{
+		Command: slice[0],
+		Args:    slice[1:],
+		Version: godis.PROTOBUF_VERSION,
+	}
+	switch {
+	case compression == "":
+		cmd.Compression = godis.COMPRESSION_FLATE
+	case proto.Size(cmd) >= godis.COMPRESSION_THRESHOLD_DEFAULT:
+		raw, err := proto.Marshal(cmd)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false, nil
+		}
+		if compressed := godis.Deflate(raw); len(compressed) < len(raw) {
+			cmd = &myProto.Cmd{Compressed: compressed}
+		}
+	}
+	_, err = protodelim.MarshalTo(conn, cmd)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		return false, err
 	}
-	switch reply.ReplyType {
-	case int64(godis.RE_NONE):
-		fmt.Print("(nil)\n")
-	case int64(godis.RE_OK):
-		for _, value := range reply.Args {
-			fmt.Println(value)
-		}
-	case int64(godis.RE_INT):
-		fmt.Print("(integer) ")
-		for _, value := range reply.Args {
-			fmt.Println(value)
-		}
-	case int64(godis.RE_ERR):
-		fmt.Print("(error) ")
-		for _, value := range reply.Args {
-			fmt.Println(value)
-		}
-	case int64(godis.RE_STRING):
-		fmt.Printf("\"%s\"\n", reply.Args[0])
-	case int64(godis.RE_HASH):
-		if len(reply.Args) == 0 {
-			fmt.Println("(empty array)")
-		} else {
-			for i := 0; i < len(reply.Args); i++ {
-				fmt.Printf("%d) \" %s\"\n", i+1, reply.Args[i])
-			}
+	return true, nil
+}
+
+// splitArgs splits a line into arguments like redis-cli does. Arguments may
+// be quoted: "..." understands \n, \r, \t, \b, \a, \xHH and \ escapes,
+// '...' only \'. Arbitrary bytes can be sent this way.
+func splitArgs(line string) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && strings.IndexByte(" \n\r\t\v\f", line[i]) >= 0 {
+			i++
 		}
-	case int64(godis.RE_LIST):
-		if len(reply.Args) == 0 {
-			fmt.Println("(empty array)")
-		} else {
-			for i := 0; i < len(reply.Args); i++ {
-				fmt.Printf("%d) \" %s\"\n", i+1, reply.Args[i])
-			}
+		if i == len(line) {
+			return args, nil
 		}
-	case int64(godis.RE_SET):
-		if len(reply.Args) == 0 {
-			fmt.Println("(empty array)")
-		} else {
-			for i := 0; i < len(reply.Args); i++ {
-				fmt.Printf("%d) \" %s\"\n", i+1, reply.Args[i])
+		var arg []byte
+		inq, insq := false, false
+		for done := false; !done; {
+			if inq {
+				switch {
+				case i == len(line):
+					return nil, fmt.Errorf("unbalanced quotes")
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				case line[i] == '"':
+					// the closing quote must be followed by a space or
+					// nothing at all
+					if i+1 < len(line) && strings.IndexByte(" \n\r\t\v\f", line[i+1]) < 0 {
+						return nil, fmt.Errorf("unbalanced quotes")
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else if insq {
+				switch {
+				case i == len(line):
+					return nil, fmt.Errorf("unbalanced quotes")
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && strings.IndexByte(" \n\r\t\v\f", line[i+1]) < 0 {
+						return nil, fmt.Errorf("unbalanced quotes")
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else {
+				switch {
+				case i == len(line) || strings.IndexByte(" \n\r\t\v\f", line[i]) >= 0:
+					done = true
+				case line[i] == '"' && len(arg) == 0:
+					inq = true
+				case line[i] == '\'' && len(arg) == 0:
+					insq = true
+				default:
+					arg = append(arg, line[i])
+				}
 			}
-		}
-	case int64(godis.RE_ZSET):
-		if len(reply.Args) == 0 {
-			fmt.Println("(empty array)")
-		} else {
-			for i := 0; i < len(reply.Args); i++ {
-				fmt.Printf("%d) \" %s\"\n", i+1, reply.Args[i])
+			if i < len(line) {
+				i++
 			}
 		}
-	case int64(godis.RE_FLOAT):
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
 
-		fmt.Printf("\"%s\"\n", reply.Args[0])
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
 
+func hexValue(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
 	default:
-		for _, value := range reply.Args {
-			fmt.Println(value)
+		return c - 'A' + 10
+	}
+}
+
+// repr quotes a value the way redis-cli prints it, escaping non printable
+// bytes so binary values are readable.
+func repr(b []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range b {
+		switch c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString("\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case '\t':
+			sb.WriteString("\\t")
+		case '\a':
+			sb.WriteString("\\a")
+		case '\b':
+			sb.WriteString("\\b")
+		default:
+			if c >= 0x20 && c < 0x7f {
+				sb.WriteByte(c)
+			} else {
+				fmt.Fprintf(&sb, "\\x%02x", c)
+			}
 		}
 	}
+	sb.WriteByte('"')
+	return sb.String()
+}
 
+// recvReply reads and prints a reply, a large one streamed in chunks is put
+// back together first.
+func recvReply(reader *bufio.Reader) error {
+	var value *myProto.Value
+	for {
+		var reply myProto.Reply
+		err := protodelim.UnmarshalOptions{MaxSize: -1}.UnmarshalFrom(reader, &reply)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+		compression = reply.Compression
+		if len(reply.Compressed) > 0 {
+			raw, err := godis.Inflate(reply.Compressed, godis.COMPRESSION_MAX_INFLATED_LEN)
+			if err == nil {
+				err = proto.Unmarshal(raw, &reply)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return err
+			}
+		}
+		value = godis.MergeReplyChunk(value, reply.Value)
+		if !reply.More {
+			break
+		}
+	}
+	fmt.Print(formatValue(value, ""))
+	return nil
+}
+
+// formatValue formats a reply value the way redis-cli does, the elements of
+// nested aggregates are indented under their parent.
+func formatValue(v *myProto.Value, indent string) string {
+	switch k := v.GetKind().(type) {
+	case *myProto.Value_Integer:
+		return fmt.Sprintf("(integer) %d\n", k.Integer)
+	case *myProto.Value_Double:
+		return fmt.Sprintf("(double) %s\n", strconv.FormatFloat(k.Double, 'g', -1, 64))
+	case *myProto.Value_Bulk:
+		return repr(k.Bulk) + "\n"
+	case *myProto.Value_Status:
+		return k.Status + "\n"
+	case *myProto.Value_Error:
+		return "(error) " + k.Error + "\n"
+	case *myProto.Value_Array:
+		return formatAggregate(k.Array.Values, indent)
+	case *myProto.Value_Set:
+		return formatAggregate(k.Set.Values, indent)
+	case *myProto.Value_Push:
+		return formatAggregate(k.Push.Values, indent)
+	case *myProto.Value_Map:
+		if len(k.Map.Entries) == 0 {
+			return "(empty hash)\n"
+		}
+		var b strings.Builder
+		width := len(strconv.Itoa(len(k.Map.Entries)))
+		for i, e := range k.Map.Entries {
+			if i > 0 {
+				b.WriteString(indent)
+			}
+			prefix := fmt.Sprintf("%*d# ", width, i+1)
+			key := strings.TrimSuffix(formatValue(e.Key, ""), "\n") + " => "
+			b.WriteString(prefix + key)
+			b.WriteString(formatValue(e.Value, indent+strings.Repeat(" ", len(prefix)+len(key))))
+		}
+		return b.String()
+	default:
+		return "(nil)\n"
+	}
+}
+
+func formatAggregate(values []*myProto.Value, indent string) string {
+	if len(values) == 0 {
+		return "(empty array)\n"
+	}
+	var b strings.Builder
+	width := len(strconv.Itoa(len(values)))
+	for i, v := range values {
+		if i > 0 {
+			b.WriteString(indent)
+		}
+		prefix := fmt.Sprintf("%*d) ", width, i+1)
+		b.WriteString(prefix)
+		b.WriteString(formatValue(v, indent+strings.Repeat(" ", len(prefix))))
+	}
+	return b.String()
 }
@@ -2,8 +2,13 @@ package main
 
 import (
 	"godisdb/godis"
+	"os"
 )
 
 func main() {
-	godis.Run()
+	configfile := ""
+	if len(os.Args) > 1 {
+		configfile = os.Args[1]
+	}
+	godis.Run(configfile)
 }